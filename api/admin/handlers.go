@@ -0,0 +1,73 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/acubed-tm/edge/helpers"
+	"github.com/go-chi/chi"
+)
+
+func getBreakers(w http.ResponseWriter, r *http.Request) {
+	helpers.WriteSuccessJson(w, r, helpers.BreakerSnapshots())
+}
+
+func resetBreaker(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	for _, s := range helpers.BreakerSnapshots() {
+		if s.Name == name {
+			helpers.GetBreaker(name).Reset()
+			helpers.WriteSuccess(w, r)
+			return
+		}
+	}
+
+	helpers.WriteErrorJson(w, r, errors.New("breaker not found"))
+}
+
+var breakerStates = []helpers.BreakerState{helpers.BreakerClosed, helpers.BreakerOpen, helpers.BreakerHalfOpen}
+
+// Metrics writes the state of the edge in the Prometheus text format
+func Metrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	snapshots := helpers.BreakerSnapshots()
+
+	fmt.Fprintln(w, "# HELP edge_breaker_state Whether the circuit breaker is in the state.")
+	fmt.Fprintln(w, "# TYPE edge_breaker_state gauge")
+	for _, s := range snapshots {
+		for _, state := range breakerStates {
+			value := 0
+			if s.State == state {
+				value = 1
+			}
+			fmt.Fprintf(w, "edge_breaker_state{breaker=%q,state=%q} %d\n", s.Name, state, value)
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP edge_breaker_failure_rate Share of failed calls in the window of the breaker.")
+	fmt.Fprintln(w, "# TYPE edge_breaker_failure_rate gauge")
+	for _, s := range snapshots {
+		fmt.Fprintf(w, "edge_breaker_failure_rate{breaker=%q} %g\n", s.Name, s.FailureRate)
+	}
+
+	fmt.Fprintln(w, "# HELP edge_breaker_slow_rate Share of slow calls in the window of the breaker.")
+	fmt.Fprintln(w, "# TYPE edge_breaker_slow_rate gauge")
+	for _, s := range snapshots {
+		fmt.Fprintf(w, "edge_breaker_slow_rate{breaker=%q} %g\n", s.Name, s.SlowRate)
+	}
+
+	fmt.Fprintln(w, "# HELP edge_breaker_rejected_total Calls failed fast by the breaker.")
+	fmt.Fprintln(w, "# TYPE edge_breaker_rejected_total counter")
+	for _, s := range snapshots {
+		fmt.Fprintf(w, "edge_breaker_rejected_total{breaker=%q} %d\n", s.Name, s.Rejected)
+	}
+
+	fmt.Fprintln(w, "# HELP edge_breaker_trips_total Times the breaker opened.")
+	fmt.Fprintln(w, "# TYPE edge_breaker_trips_total counter")
+	for _, s := range snapshots {
+		fmt.Fprintf(w, "edge_breaker_trips_total{breaker=%q} %d\n", s.Name, s.Trips)
+	}
+}
@@ -0,0 +1,16 @@
+package admin
+
+import (
+	"github.com/acubed-tm/edge/helpers"
+	"github.com/go-chi/chi"
+)
+
+func Routes() *chi.Mux {
+	router := chi.NewRouter()
+	router.Use(helpers.RequireAuthentication, helpers.RequireAdmin)
+
+	router.Get("/breakers", getBreakers)
+	router.Post("/breaker/{name}/reset", resetBreaker)
+
+	return router
+}
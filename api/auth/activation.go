@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/acubed-tm/edge/helpers"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// After following an activation link the browser is sent on to
+// ACTIVATION_SUCCESS_URL or ACTIVATION_FAILURE_URL, with the outcome in the
+// reason query parameter. Links carrying an organisation query parameter use
+// ACTIVATION_<ORGANISATION>_SUCCESS_URL and _FAILURE_URL when those are set.
+// Clients that accept application/json get the outcome as JSON instead.
+
+const (
+	activationVerified        = "verified"
+	activationInvalidToken    = "invalid_token"
+	activationAlreadyVerified = "already_verified"
+	activationUnavailable     = "unavailable"
+)
+
+func activationUrl(organisation string, success bool) string {
+	setting := "FAILURE_URL"
+	if success {
+		setting = "SUCCESS_URL"
+	}
+	def := helpers.GetEnvString("ACTIVATION_"+setting, "https://portal.acubed.app")
+	if organisation == "" {
+		return def
+	}
+	return helpers.GetEnvString(helpers.EnvKey("ACTIVATION", organisation, setting), def)
+}
+
+// activationReason maps the error of ActivateEmail to the reason shown to the user
+func activationReason(err error) string {
+	switch status.Code(err) {
+	case codes.OK:
+		return activationVerified
+	case codes.NotFound, codes.InvalidArgument, codes.PermissionDenied:
+		return activationInvalidToken
+	case codes.FailedPrecondition, codes.AlreadyExists:
+		return activationAlreadyVerified
+	default:
+		return activationUnavailable
+	}
+}
+
+func writeActivationOutcome(w http.ResponseWriter, r *http.Request, err error) {
+	reason := activationReason(err)
+	if reason == activationUnavailable {
+		log.Printf("Could not activate email: %v", err)
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		switch reason {
+		case activationVerified:
+			helpers.WriteSuccessJson(w, r, map[string]string{"reason": reason})
+		case activationInvalidToken:
+			helpers.WriteErrorJsonStatus(w, r, http.StatusBadRequest, errors.New("activation token is invalid or expired"))
+		case activationAlreadyVerified:
+			helpers.WriteErrorJsonStatus(w, r, http.StatusConflict, errors.New("email is already verified"))
+		default:
+			helpers.WriteErrorJson(w, r, err)
+		}
+		return
+	}
+
+	target, parseErr := url.Parse(activationUrl(r.URL.Query().Get("organisation"), reason == activationVerified))
+	if parseErr != nil {
+		log.Printf("Invalid activation landing URL: %v", parseErr)
+		helpers.WriteErrorJsonStatus(w, r, http.StatusInternalServerError, errors.New("activation landing is misconfigured"))
+		return
+	}
+	query := target.Query()
+	query.Set("reason", reason)
+	target.RawQuery = query.Encode()
+
+	// the outcome differs per token and over time, so the redirect can't be cached
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, target.String(), http.StatusSeeOther)
+}
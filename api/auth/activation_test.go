@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/acubed-tm/edge/helpers"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestActivationReason(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"activated", nil, activationVerified},
+		{"unknown token", status.Error(codes.NotFound, "no such token"), activationInvalidToken},
+		{"malformed token", status.Error(codes.InvalidArgument, "bad token"), activationInvalidToken},
+		{"expired token", status.Error(codes.PermissionDenied, "expired"), activationInvalidToken},
+		{"already verified", status.Error(codes.FailedPrecondition, "verified"), activationAlreadyVerified},
+		{"already exists", status.Error(codes.AlreadyExists, "verified"), activationAlreadyVerified},
+		{"service down", status.Error(codes.Unavailable, "down"), activationUnavailable},
+		{"circuit open", helpers.ErrCircuitOpen, activationUnavailable},
+		{"other error", errors.New("boom"), activationUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := activationReason(tt.err); got != tt.want {
+				t.Errorf("activationReason = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteActivationOutcome(t *testing.T) {
+	env := map[string]string{
+		"ACTIVATION_SUCCESS_URL":        "https://portal.example.com/activated",
+		"ACTIVATION_FAILURE_URL":        "https://portal.example.com/activation-failed",
+		"ACTIVATION_ORG_1_SUCCESS_URL":  "https://org.example.com/welcome?lang=nl",
+		"ACTIVATION_BROKEN_SUCCESS_URL": "://no scheme",
+	}
+	for k, v := range env {
+		_ = os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	tests := []struct {
+		name         string
+		err          error
+		organisation string
+		accept       string
+		wantStatus   int
+		wantLocation string
+	}{
+		{"verified", nil, "", "", http.StatusSeeOther, "https://portal.example.com/activated?reason=verified"},
+		{"invalid token", status.Error(codes.NotFound, ""), "", "", http.StatusSeeOther, "https://portal.example.com/activation-failed?reason=invalid_token"},
+		{"unavailable", status.Error(codes.Unavailable, ""), "", "", http.StatusSeeOther, "https://portal.example.com/activation-failed?reason=unavailable"},
+		{"organisation landing", nil, "org-1", "", http.StatusSeeOther, "https://org.example.com/welcome?lang=nl&reason=verified"},
+		{"organisation without a failure landing", status.Error(codes.FailedPrecondition, ""), "org-1", "", http.StatusSeeOther, "https://portal.example.com/activation-failed?reason=already_verified"},
+		{"unknown organisation", nil, "org-2", "", http.StatusSeeOther, "https://portal.example.com/activated?reason=verified"},
+		{"misconfigured landing", nil, "broken", "", http.StatusInternalServerError, ""},
+		{"json verified", nil, "", "application/json", http.StatusOK, ""},
+		{"json invalid token", status.Error(codes.NotFound, ""), "", "application/json", http.StatusBadRequest, ""},
+		{"json already verified", status.Error(codes.AlreadyExists, ""), "", "application/json", http.StatusConflict, ""},
+		{"json circuit open", helpers.ErrCircuitOpen, "", "application/json", http.StatusServiceUnavailable, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "/activate/token"
+			if tt.organisation != "" {
+				target += "?organisation=" + tt.organisation
+			}
+			r := httptest.NewRequest(http.MethodGet, target, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+
+			writeActivationOutcome(w, r, tt.err)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", got, tt.wantLocation)
+			}
+			if tt.wantStatus == http.StatusSeeOther && w.Header().Get("Cache-Control") != "no-store" {
+				t.Errorf("Cache-Control = %q, want no-store", w.Header().Get("Cache-Control"))
+			}
+		})
+	}
+}
@@ -4,8 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log"
+	"math"
 	"net/http"
 
+	"github.com/acubed-tm/edge/api/profile"
+	"github.com/acubed-tm/edge/api/webhooks"
 	"github.com/acubed-tm/edge/helpers"
 	proto "github.com/acubed-tm/edge/protofiles"
 	"github.com/go-chi/chi"
@@ -29,6 +33,7 @@ func register(w http.ResponseWriter, r *http.Request) {
 	_, err = helpers.RunGrpc(service, func(ctx context.Context, conn *grpc.ClientConn) (interface{}, error) {
 		// Contact the server and print out its response.
 		c := proto.NewAuthServiceClient(conn)
+		ctx = helpers.WithIdempotencyKey(ctx, helpers.GetIdempotencyKey(r))
 		_, err := c.Register(ctx, &proto.RegisterRequest{Email: req.Email, Password: req.Password})
 		if err != nil {
 			return nil, errors.New(fmt.Sprintf("could not log in: %v", err))
@@ -41,13 +46,48 @@ func register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	go publishRegistration(req.Email)
+
 	helpers.WriteSuccess(w, r)
 }
 
+// publishRegistration lets every organisation that invited the email know it registered
+func publishRegistration(email string) {
+	type registered struct {
+		Email string `json:"email"`
+	}
+
+	organisations, err := helpers.GetInvitingOrganisations(email)
+	if err != nil {
+		log.Printf("Could not get invites of registered account: %v", err)
+		return
+	}
+
+	webhooks.PublishAll(organisations, webhooks.AccountRegistered, registered{Email: email})
+}
+
+// tokenReply is the token handed out by authenticate, or the CSRF token to
+// go with it when it's kept in a session cookie
+type tokenReply struct {
+	Token     string `json:"token,omitempty"`
+	CsrfToken string `json:"csrfToken,omitempty"`
+}
+
+// writeTokens returns the token, or keeps it in a session cookie when cookie is set
+func writeTokens(w http.ResponseWriter, r *http.Request, tokens tokenReply, cookie bool) {
+	if cookie {
+		csrf := helpers.SetSessionCookie(w, tokens.Token)
+		helpers.WriteSuccessJson(w, r, tokenReply{CsrfToken: csrf})
+		return
+	}
+	helpers.WriteSuccessJson(w, r, tokens)
+}
+
 func authenticate(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		Cookie   bool   `json:"cookie"` // keep the token in a session cookie instead of returning it
 	}
 
 	err := helpers.GetJsonFromRequestBody(r, &req)
@@ -56,8 +96,9 @@ func authenticate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	type reply struct {
-		Token string `json:"token"`
+	if req.Cookie && !helpers.IsSessionModeEnabled() {
+		helpers.WriteErrorJson(w, r, errors.New("cookie sessions are not enabled"))
+		return
 	}
 
 	resp, err := helpers.RunGrpc(service, func(ctx context.Context, conn *grpc.ClientConn) (interface{}, error) {
@@ -67,7 +108,7 @@ func authenticate(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			return nil, errors.New(fmt.Sprintf("could not log in: %v", err))
 		}
-		return reply{Token: resp.Token}, nil
+		return tokenReply{Token: resp.Token}, nil
 	})
 
 	if err != nil {
@@ -75,7 +116,7 @@ func authenticate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	helpers.WriteSuccessJson(w, r, resp)
+	writeTokens(w, r, resp.(tokenReply), req.Cookie)
 }
 
 func getUserUuidAndInvites(w http.ResponseWriter, r *http.Request) {
@@ -142,19 +183,10 @@ func verifyEmail(w http.ResponseWriter, r *http.Request) {
 
 	_, err := helpers.RunGrpc(service, func(ctx context.Context, conn *grpc.ClientConn) (interface{}, error) {
 		c := proto.NewAuthServiceClient(conn)
-		_, err := c.ActivateEmail(ctx, &proto.ActivateEmailRequest{Token: emailVerificationToken})
-		if err != nil {
-			return nil, errors.New(err.Error())
-		}
-		return nil, nil
+		return c.ActivateEmail(ctx, &proto.ActivateEmailRequest{Token: emailVerificationToken})
 	})
 
-	if err != nil {
-		helpers.WriteErrorJson(w, r, err)
-		return
-	}
-
-	http.Redirect(w, r, "https://portal.acubed.app", 301)
+	writeActivationOutcome(w, r, err)
 }
 
 func dropCurrentToken(w http.ResponseWriter, r *http.Request) {
@@ -178,6 +210,7 @@ func dropCurrentToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	helpers.ClearSessionCookie(w)
 	helpers.WriteSuccess(w, r)
 }
 
@@ -202,6 +235,7 @@ func dropAllTokens(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	helpers.ClearSessionCookie(w)
 	helpers.WriteSuccess(w, r)
 }
 
@@ -238,16 +272,21 @@ func updateEmail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// we only know the email, not whose it is
+	profile.UserEmails.InvalidateAll()
+
 	helpers.WriteSuccess(w, r)
 }
 
+type addEmailRequest struct {
+	UserUuid string `json:"userUuid"`
+	Email    string `json:"email"`
+	// the organisation the email is added through, if any, for the verification link
+	Organisation string `json:"organisation,omitempty"`
+}
+
 func addEmail(w http.ResponseWriter, r *http.Request) {
-	// TODO(authorization): if admin or self
-	// TODO: send verification email
-	var req struct {
-		UserUuid string `json:"userUuid"`
-		Email    string `json:"email"`
-	}
+	var req addEmailRequest
 
 	err := helpers.GetJsonFromRequestBody(r, &req)
 	if err != nil {
@@ -255,23 +294,59 @@ func addEmail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = helpers.RunGrpc(service, func(ctx context.Context, conn *grpc.ClientConn) (interface{}, error) {
+	if req.UserUuid != helpers.GetCurrentAccountUuid(r) && !helpers.IsAdmin(r) {
+		helpers.WriteErrorJsonStatus(w, r, http.StatusForbidden, errors.New("can only add emails to your own account"))
+		return
+	}
+
+	addAndVerifyEmail(w, r, req)
+}
+
+// addAccountEmail adds the email to the account, lets the organisations of
+// the account know, and returns the verification token of the email
+var addAccountEmail = func(r *http.Request, req addEmailRequest) (string, error) {
+	resp, err := helpers.RunGrpc(service, func(ctx context.Context, conn *grpc.ClientConn) (interface{}, error) {
 		c := proto.NewAuthServiceClient(conn)
-		_, err := c.AddEmail(ctx, &proto.AddEmailRequest{ // returns verification token and email uuid
+		ctx = helpers.WithIdempotencyKey(ctx, helpers.GetIdempotencyKey(r))
+		return c.AddEmail(ctx, &proto.AddEmailRequest{
 			AccountUuid: req.UserUuid,
 			Email:       req.Email,
 		})
-		if err != nil {
-			return nil, err
-		}
-		return nil, nil
 	})
+	if err != nil {
+		return "", err
+	}
 
+	profile.UserEmails.Invalidate(req.UserUuid)
+	go profile.PublishAccountEvent(req.UserUuid, webhooks.EmailAdded, req)
+
+	return resp.(*proto.AddEmailReply).VerificationToken, nil
+}
+
+// addAndVerifyEmail adds the email and mails its verification link. The mail
+// slot is reserved up front, so an address that got too many already isn't
+// added without one, and given back when nothing was sent.
+func addAndVerifyEmail(w http.ResponseWriter, r *http.Request, req addEmailRequest) {
+	if ok, wait := reserveVerificationMail(req.Email); !ok {
+		w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+		helpers.WriteErrorJsonStatus(w, r, http.StatusTooManyRequests, errors.New("verification mail was sent too often, try again later"))
+		return
+	}
+
+	token, err := addAccountEmail(r, req)
 	if err != nil {
+		releaseVerificationMail(req.Email)
 		helpers.WriteErrorJson(w, r, err)
 		return
 	}
 
+	if err := sendVerificationMail(req.Email, token, req.Organisation); err != nil {
+		releaseVerificationMail(req.Email)
+		log.Printf("Could not send verification for email %s: %v", req.Email, err)
+		helpers.WriteErrorJson(w, r, errors.New("email was added, but its verification mail could not be sent"))
+		return
+	}
+
 	helpers.WriteSuccess(w, r)
 }
 
@@ -295,29 +370,8 @@ func deleteEmail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	helpers.WriteSuccess(w, r)
-}
-
-// TODO: should move this to helper function
-func _(w http.ResponseWriter, r *http.Request) (string, error) { // getCurrentUserUuid
-	token, err := helpers.GetJwtToken(r)
-	if err != nil {
-		helpers.WriteErrorJson(w, r, err)
-		return "", nil
-	}
-
-	accountUuid, err := helpers.RunGrpc(service, func(ctx context.Context, conn *grpc.ClientConn) (interface{}, error) {
-		// Contact the server and print out its response.
-		c := proto.NewAuthServiceClient(conn)
-		resp, err := c.GetUuidFromToken(ctx, &proto.GetUuidFromTokenRequest{Token: token})
-		if err != nil {
-			return "", errors.New(err.Error())
-		}
-		return resp.Uuid, nil
-	})
+	// we only know the email, not whose it is
+	profile.UserEmails.InvalidateAll()
 
-	if err != nil {
-		return "", err
-	}
-	return accountUuid.(string), nil
+	helpers.WriteSuccess(w, r)
 }
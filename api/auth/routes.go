@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"github.com/acubed-tm/edge/helpers"
 	"github.com/go-chi/chi"
 )
 
@@ -10,11 +11,11 @@ func Routes() *chi.Mux {
 	router.Post("/register", register)
 	router.Post("/meet", getUserUuidAndInvites) // used to be at /check-registration
 	router.Get("/activate/{token}", verifyEmail)
-	router.Get("/close", dropCurrentToken)
-	router.Get("/logout", dropAllTokens)
+	router.Post("/close", dropCurrentToken)
+	router.Post("/logout", dropAllTokens)
 
 	router.Put("/email/{uuid}", updateEmail)
-	router.Post("/email", addEmail)
+	router.With(helpers.RequireAuthentication).Post("/email", addEmail)
 	router.Delete("/email/{uuid}", deleteEmail)
 
 	return router
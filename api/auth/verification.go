@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/acubed-tm/edge/helpers"
+)
+
+var (
+	// the verification token is appended to this
+	emailActivationUrl = helpers.GetEnvString("EMAIL_ACTIVATION_URL", "https://api.acubed.app/v1/auth/activate/")
+
+	// an address gets at most one verification mail a minute, and a few a
+	// day, per replica
+	verificationLimits = []*helpers.RateLimiter{
+		helpers.NewRateLimiter("verification_mail", 1, time.Minute),
+		helpers.NewRateLimiter("verification_mail_daily", 5, 24*time.Hour),
+	}
+)
+
+// sendVerificationMail mails the activation link, which carries the
+// organisation when it's known so it lands on that organisation's pages
+func sendVerificationMail(email, token, organisation string) error {
+	link := emailActivationUrl + url.PathEscape(token)
+	if organisation != "" {
+		link += "?" + url.Values{"organisation": {organisation}}.Encode()
+	}
+	return helpers.SendMail(helpers.Mail{
+		To:      email,
+		Subject: "Verify your email address for aCubed",
+		Body: "This address was added to an aCubed account.\n\n" +
+			"Verify it by opening " + link + "\n\n" +
+			"If you didn't expect this, you can ignore this mail.",
+	})
+}
+
+func verificationKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// reserveVerificationMail takes a slot for a verification mail to the
+// address from every limit, or none and how long to wait when one of them is
+// used up
+func reserveVerificationMail(email string) (bool, time.Duration) {
+	key := verificationKey(email)
+	for i, limiter := range verificationLimits {
+		if ok, wait := limiter.Reserve(key); !ok {
+			for _, reserved := range verificationLimits[:i] {
+				reserved.Release(key)
+			}
+			return false, wait
+		}
+	}
+	return true, 0
+}
+
+// releaseVerificationMail gives back the slot of a mail that didn't go out
+func releaseVerificationMail(email string) {
+	key := verificationKey(email)
+	for _, limiter := range verificationLimits {
+		limiter.Release(key)
+	}
+}
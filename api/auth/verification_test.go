@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/acubed-tm/edge/helpers"
+)
+
+type fakeMailer struct {
+	mu   sync.Mutex
+	sent []helpers.Mail
+	err  error
+}
+
+func (m *fakeMailer) Send(mail helpers.Mail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.sent = append(m.sent, mail)
+	return nil
+}
+
+var testMailer = &fakeMailer{}
+
+func init() {
+	helpers.RegisterMailer("test", func() (helpers.Mailer, error) { return testMailer, nil })
+	_ = os.Setenv("MAILER", "test")
+}
+
+// useTestVerification starts from empty verification limits and an empty
+// mailer that fails with mailErr, and stubs AddEmail to fail with addErr. It
+// returns how often AddEmail was called and a func that restores everything.
+func useTestVerification(mailErr, addErr error) (*int, func()) {
+	previousLimits, previousAdd := verificationLimits, addAccountEmail
+	verificationLimits = []*helpers.RateLimiter{
+		helpers.NewRateLimiter("test_verification", 1, time.Minute),
+		helpers.NewRateLimiter("test_verification_daily", 2, 24*time.Hour),
+	}
+
+	calls := 0
+	addAccountEmail = func(_ *http.Request, _ addEmailRequest) (string, error) {
+		calls++
+		return "token", addErr
+	}
+
+	testMailer.mu.Lock()
+	testMailer.sent, testMailer.err = nil, mailErr
+	testMailer.mu.Unlock()
+
+	return &calls, func() {
+		verificationLimits, addAccountEmail = previousLimits, previousAdd
+	}
+}
+
+func addTestEmail(email string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/email", nil)
+	addAndVerifyEmail(w, r, addEmailRequest{UserUuid: "account", Email: email, Organisation: "org-1"})
+	return w
+}
+
+func TestAddAndVerifyEmail(t *testing.T) {
+	calls, restore := useTestVerification(nil, nil)
+	defer restore()
+
+	if w := addTestEmail("user@example.com"); w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Fatalf("first email: %d %s", w.Code, w.Body)
+	}
+	if len(testMailer.sent) != 1 {
+		t.Fatalf("%d mails sent, want 1", len(testMailer.sent))
+	}
+	if mail := testMailer.sent[0]; mail.To != "user@example.com" || !strings.Contains(mail.Body, "/activate/token?organisation=org-1") {
+		t.Errorf("mail to %s with body %q", mail.To, mail.Body)
+	}
+
+	// the same address, written differently, within the minute
+	w := addTestEmail(" User@Example.com")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("second email: %d, Retry-After %q, want 429 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+	if *calls != 1 {
+		t.Errorf("AddEmail called %d times, want 1: a limited address shouldn't be added", *calls)
+	}
+
+	if w := addTestEmail("other@example.com"); w.Code != http.StatusOK {
+		t.Errorf("other address was limited: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestAddAndVerifyEmailDailyLimit(t *testing.T) {
+	_, restore := useTestVerification(nil, nil)
+	defer restore()
+	// only the daily limit is left
+	verificationLimits[0] = helpers.NewRateLimiter("test_verification_unlimited", 10, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if w := addTestEmail("user@example.com"); w.Code != http.StatusOK {
+			t.Fatalf("email %d: %d %s", i, w.Code, w.Body)
+		}
+	}
+	if w := addTestEmail("user@example.com"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("third email: %d, want 429", w.Code)
+	}
+	// a hit of the minute limit is given back when the daily one refuses
+	for i := 0; i < 8; i++ {
+		if ok, _ := verificationLimits[0].Reserve("user@example.com"); !ok {
+			t.Fatalf("minute limit kept the refused reservation")
+		}
+	}
+}
+
+func TestAddAndVerifyEmailFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		mailErr error
+		addErr  error
+		want    string
+	}{
+		{"mail fails", errors.New("smtp is down"), nil, "verification mail could not be sent"},
+		{"add fails", nil, errors.New("email is taken"), "email is taken"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, restore := useTestVerification(tt.mailErr, tt.addErr)
+			defer restore()
+
+			w := addTestEmail("user@example.com")
+			if !strings.Contains(w.Body.String(), tt.want) {
+				t.Errorf("reply %s, want an error containing %q", w.Body, tt.want)
+			}
+			if len(testMailer.sent) != 0 {
+				t.Errorf("%d mails sent", len(testMailer.sent))
+			}
+
+			// nothing went out, so trying again isn't limited
+			w = addTestEmail("user@example.com")
+			if w.Code == http.StatusTooManyRequests {
+				t.Error("retry was limited after a failure")
+			}
+			if *calls != 2 {
+				t.Errorf("AddEmail called %d times, want 2", *calls)
+			}
+		})
+	}
+}
@@ -2,16 +2,96 @@ package profile
 
 import (
 	"context"
-	"errors"
+	"github.com/acubed-tm/edge/api/webhooks"
 	"github.com/acubed-tm/edge/helpers"
 	proto "github.com/acubed-tm/edge/protofiles"
 	"github.com/go-chi/chi"
 	"google.golang.org/grpc"
+	"log"
 	"net/http"
 )
 
 const service = "profile-service.acubed:50551"
 
+var (
+	userProfiles         = helpers.NewCache("profiles")
+	organisationProfiles = helpers.NewCache("organisations")
+	// UserEmails is invalidated by the auth routes that change emails
+	UserEmails = helpers.NewCache("emails")
+)
+
+// userEmail is an email of an account, as listed by GET /user/{uuid}/emails
+type userEmail struct {
+	Email     string `json:"emailAddress"`
+	IsPrimary bool   `json:"isPrimary"`
+	Uuid      string `json:"uuid"`
+}
+
+// getEmails returns the emails of the account
+func getEmails(uuid string) ([]userEmail, helpers.CacheInfo, error) {
+	emails, cacheInfo, err := UserEmails.Get(uuid, func() (interface{}, error) {
+		return helpers.RunGrpc(service, func(ctx context.Context, conn *grpc.ClientConn) (interface{}, error) {
+			c := proto.NewProfileServiceClient(conn)
+			emails, err := c.GetEmails(ctx, &proto.GetEmailsRequest{Uuid: uuid})
+			if err != nil {
+				return nil, err
+			}
+
+			ret := make([]userEmail, len(emails.Emails))
+			for i, e := range emails.Emails {
+				ret[i] = userEmail{
+					Email:     e.Email,
+					IsPrimary: e.IsPrimary,
+					Uuid:      e.Uuid,
+				}
+			}
+
+			return ret, nil
+		})
+	})
+	if err != nil {
+		return nil, cacheInfo, err
+	}
+	return emails.([]userEmail), cacheInfo, nil
+}
+
+// PublishAccountEvent sends a webhook event about the account to the
+// organisations that invited any of its emails. Those are the only ones the
+// edge can tell it belongs to.
+func PublishAccountEvent(accountUuid, eventType string, data interface{}) {
+	emails, _, err := getEmails(accountUuid)
+	if err != nil {
+		log.Printf("Could not get emails of account for %s event: %v", eventType, err)
+		return
+	}
+
+	var organisations []string
+	seen := map[string]bool{}
+	for _, e := range emails {
+		invites, err := helpers.GetInvitingOrganisations(e.Email)
+		if err != nil {
+			log.Printf("Could not get invites of account for %s event: %v", eventType, err)
+			return
+		}
+		for _, organisation := range invites {
+			if !seen[organisation] {
+				seen[organisation] = true
+				organisations = append(organisations, organisation)
+			}
+		}
+	}
+
+	webhooks.PublishAll(organisations, eventType, data)
+}
+
+// profileEvent is the webhook payload of a created or updated profile
+func profileEvent(uuid string, profile interface{}) interface{} {
+	return struct {
+		Uuid    string      `json:"uuid"`
+		Profile interface{} `json:"profile"`
+	}{uuid, profile}
+}
+
 func getProfileUser(w http.ResponseWriter, r *http.Request) {
 	uuid := chi.URLParam(r, "uuid")
 
@@ -23,17 +103,19 @@ func getProfileUser(w http.ResponseWriter, r *http.Request) {
 		Description string `json:"description"`
 	}
 
-	response, err := helpers.RunGrpc(service, func(ctx context.Context, conn *grpc.ClientConn) (interface{}, error) {
-		c := proto.NewProfileServiceClient(conn)
-		profile, err := c.GetProfile(ctx, &proto.GetProfileRequest{Uuid: uuid})
-		if err != nil {
-			return nil, errors.New(err.Error())
-		}
-		return resp{
-			FirstName:   profile.FirstName,
-			Name:        profile.LastName,
-			Description: profile.Description,
-		}, nil
+	response, cacheInfo, err := userProfiles.Get(uuid, func() (interface{}, error) {
+		return helpers.RunGrpc(service, func(ctx context.Context, conn *grpc.ClientConn) (interface{}, error) {
+			c := proto.NewProfileServiceClient(conn)
+			profile, err := c.GetProfile(ctx, &proto.GetProfileRequest{Uuid: uuid})
+			if err != nil {
+				return nil, err
+			}
+			return resp{
+				FirstName:   profile.FirstName,
+				Name:        profile.LastName,
+				Description: profile.Description,
+			}, nil
+		})
 	})
 
 	if err != nil {
@@ -41,6 +123,7 @@ func getProfileUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	helpers.WriteCacheHeaders(w, cacheInfo)
 	helpers.WriteSuccessJson(w, r, response)
 }
 
@@ -70,7 +153,7 @@ func updateProfileUser(w http.ResponseWriter, r *http.Request) {
 			Description: req.Description,
 		})
 		if err != nil {
-			return nil, errors.New(err.Error())
+			return nil, err
 		}
 		return nil, nil
 	})
@@ -80,6 +163,9 @@ func updateProfileUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	userProfiles.Invalidate(uuid)
+	go PublishAccountEvent(uuid, webhooks.UserProfileUpdated, profileEvent(uuid, req))
+
 	helpers.WriteSuccess(w, r)
 }
 
@@ -110,7 +196,7 @@ func createProfileUser(w http.ResponseWriter, r *http.Request) {
 			Description: req.Description,
 		})
 		if err != nil {
-			return nil, errors.New(err.Error())
+			return nil, err
 		}
 		return nil, nil
 	})
@@ -120,6 +206,9 @@ func createProfileUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	userProfiles.Invalidate(uuid)
+	go PublishAccountEvent(uuid, webhooks.UserProfileCreated, profileEvent(uuid, req))
+
 	helpers.WriteSuccess(w, r)
 }
 
@@ -133,16 +222,18 @@ func getProfileOrganization(w http.ResponseWriter, r *http.Request) {
 		Description string `json:"description"`
 	}
 
-	response, err := helpers.RunGrpc(service, func(ctx context.Context, conn *grpc.ClientConn) (interface{}, error) {
-		c := proto.NewProfileServiceClient(conn)
-		profile, err := c.GetOrganizationProfile(ctx, &proto.GetOrganizationProfileRequest{Uuid: uuid})
-		if err != nil {
-			return nil, errors.New(err.Error())
-		}
-		return resp{
-			DisplayName: profile.DisplayName,
-			Description: profile.Description,
-		}, nil
+	response, cacheInfo, err := organisationProfiles.Get(uuid, func() (interface{}, error) {
+		return helpers.RunGrpc(service, func(ctx context.Context, conn *grpc.ClientConn) (interface{}, error) {
+			c := proto.NewProfileServiceClient(conn)
+			profile, err := c.GetOrganizationProfile(ctx, &proto.GetOrganizationProfileRequest{Uuid: uuid})
+			if err != nil {
+				return nil, err
+			}
+			return resp{
+				DisplayName: profile.DisplayName,
+				Description: profile.Description,
+			}, nil
+		})
 	})
 
 	if err != nil {
@@ -150,6 +241,7 @@ func getProfileOrganization(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	helpers.WriteCacheHeaders(w, cacheInfo)
 	helpers.WriteSuccessJson(w, r, response)
 }
 
@@ -177,7 +269,7 @@ func updateProfileOrganization(w http.ResponseWriter, r *http.Request) {
 			Description: req.Description,
 		})
 		if err != nil {
-			return nil, errors.New(err.Error())
+			return nil, err
 		}
 		return nil, nil
 	})
@@ -187,6 +279,9 @@ func updateProfileOrganization(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	organisationProfiles.Invalidate(uuid)
+	webhooks.Publish(uuid, webhooks.OrganisationProfileUpdated, profileEvent(uuid, req))
+
 	helpers.WriteSuccess(w, r)
 }
 
@@ -215,7 +310,7 @@ func createProfileOrganization(w http.ResponseWriter, r *http.Request) {
 			Description: req.Description,
 		})
 		if err != nil {
-			return nil, errors.New(err.Error())
+			return nil, err
 		}
 		return nil, nil
 	})
@@ -225,6 +320,9 @@ func createProfileOrganization(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	organisationProfiles.Invalidate(uuid)
+	webhooks.Publish(uuid, webhooks.OrganisationProfileCreated, profileEvent(uuid, req))
+
 	helpers.WriteSuccess(w, r)
 }
 
@@ -232,35 +330,12 @@ func getUserEmails(w http.ResponseWriter, r *http.Request) {
 	// TODO(authorization): ensure admin or self
 	uuid := chi.URLParam(r, "uuid")
 
-	type resp struct {
-		Email     string `json:"emailAddress"`
-		IsPrimary bool   `json:"isPrimary"`
-		Uuid      string `json:"uuid"`
-	}
-
-	response, err := helpers.RunGrpc(service, func(ctx context.Context, conn *grpc.ClientConn) (interface{}, error) {
-		c := proto.NewProfileServiceClient(conn)
-		emails, err := c.GetEmails(ctx, &proto.GetEmailsRequest{Uuid: uuid})
-		if err != nil {
-			return nil, errors.New(err.Error())
-		}
-
-		ret := make([]resp, len(emails.Emails))
-		for i, e := range emails.Emails {
-			ret[i] = resp{
-				Email:     e.Email,
-				IsPrimary: e.IsPrimary,
-				Uuid:      e.Uuid,
-			}
-		}
-
-		return ret, nil
-	})
-
+	response, cacheInfo, err := getEmails(uuid)
 	if err != nil {
 		helpers.WriteErrorJson(w, r, err)
 		return
 	}
 
+	helpers.WriteCacheHeaders(w, cacheInfo)
 	helpers.WriteSuccessJson(w, r, response)
 }
@@ -0,0 +1,307 @@
+package tracking
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/acubed-tm/edge/helpers"
+	"github.com/go-chi/chi"
+)
+
+// Cameras authenticate captures with a key issued for them, separate from the
+// tokens of user accounts. A key can be used in one of two ways:
+//
+//	X-Api-Key: <key id>.<secret>
+//
+// or, when the link to the edge isn't encrypted, by signing the request:
+//
+//	X-Camera-Key:       <key id>
+//	X-Camera-Timestamp: <unix time in seconds>
+//	X-Camera-Nonce:     <random string, never reused within the allowed skew>
+//	X-Camera-Signature: hex HMAC-SHA256 of
+//	                    "<method>\n<path>\n<timestamp>\n<nonce>\n<hex SHA-256 of the body>"
+//	                    keyed with the hex SHA-256 of the secret
+//
+// The edge only keeps the SHA-256 of secrets. It's enough to check signatures,
+// so the registry file still has to be protected, but not to use X-Api-Key.
+//
+// With REQUIRE_CAMERA_CREDENTIALS=true, captures without valid credentials,
+// or for another camera than the one the key was issued for, are rejected.
+// Like REQUIRE_REGISTERED_CAMERAS this needs CAMERA_REGISTRY_FILE.
+
+var (
+	cameraCredentialsRequired = helpers.GetEnvBool("REQUIRE_CAMERA_CREDENTIALS", false)
+	cameraSignatureMaxSkew    = helpers.GetEnvDuration("CAMERA_SIGNATURE_MAX_SKEW", 5*time.Minute)
+)
+
+const cameraContextKey = contextKey("camera")
+
+type contextKey string
+
+type cameraKey struct {
+	Id         string     `json:"id"`
+	CameraUuid string     `json:"camera"`
+	Secret     string     `json:"secret,omitempty"`     // only set when the key is issued
+	SecretHash string     `json:"secretHash,omitempty"` // only set in the registry
+	Created    time.Time  `json:"created"`
+	Revoked    *time.Time `json:"revoked,omitempty"`
+}
+
+var (
+	errCameraKeyNotFound      = errors.New("camera key not found")
+	errInvalidCameraSignature = errors.New("invalid camera signature")
+)
+
+func hashSecret(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+// redacted leaves out the secret and its hash, for returning the key
+func (k cameraKey) redacted() cameraKey {
+	k.Secret = ""
+	k.SecretHash = ""
+	return k
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// issueKey creates a new key for a camera, the only time its secret is returned
+func (c *cameraRegistry) issueKey(cameraUuid string) (cameraKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.cameras[cameraUuid]; !ok {
+		return cameraKey{}, errCameraNotFound
+	}
+
+	key := cameraKey{
+		Id:         "ck_" + randomHex(8),
+		CameraUuid: cameraUuid,
+		Created:    time.Now().UTC(),
+	}
+	secret := randomHex(32)
+	key.SecretHash = hashSecret(secret)
+	c.keys[key.Id] = key
+	if err := c.save(); err != nil {
+		delete(c.keys, key.Id)
+		return cameraKey{}, err
+	}
+
+	key = key.redacted()
+	key.Secret = secret
+	return key, nil
+}
+
+func (c *cameraRegistry) cameraKeys(cameraUuid string) ([]cameraKey, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if _, ok := c.cameras[cameraUuid]; !ok {
+		return nil, errCameraNotFound
+	}
+
+	ret := []cameraKey{}
+	for _, key := range c.keys {
+		if key.CameraUuid == cameraUuid {
+			ret = append(ret, key.redacted())
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Created.Before(ret[j].Created) })
+	return ret, nil
+}
+
+func (c *cameraRegistry) revokeKey(cameraUuid, id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, ok := c.keys[id]
+	if !ok || key.CameraUuid != cameraUuid {
+		return errCameraKeyNotFound
+	}
+	if key.Revoked != nil {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	key.Revoked = &now
+	c.keys[id] = key
+	if err := c.save(); err != nil {
+		key.Revoked = nil
+		c.keys[id] = key
+		return err
+	}
+	return nil
+}
+
+// activeKey returns the key with the id, as long as it and its camera are active
+func (c *cameraRegistry) activeKey(id string) (cameraKey, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	key, ok := c.keys[id]
+	if !ok || key.Revoked != nil {
+		return cameraKey{}, false
+	}
+	if cam, ok := c.cameras[key.CameraUuid]; !ok || cam.Status != cameraActive {
+		return cameraKey{}, false
+	}
+	return key, true
+}
+
+// useNonce returns false if the nonce was already used with the key
+func (c *cameraRegistry) useNonce(keyId, nonce string) bool {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, expires := range c.nonces {
+		if now.After(expires) {
+			delete(c.nonces, k)
+		}
+	}
+
+	k := keyId + "\n" + nonce
+	if _, ok := c.nonces[k]; ok {
+		return false
+	}
+	// a replay after this would fail on the timestamp anyway
+	c.nonces[k] = now.Add(2 * cameraSignatureMaxSkew)
+	return true
+}
+
+// authenticateCamera returns the uuid of the camera the request has credentials for
+func authenticateCamera(r *http.Request) (string, error) {
+	if apiKey := r.Header.Get("X-Api-Key"); apiKey != "" {
+		parts := strings.SplitN(apiKey, ".", 2)
+		if len(parts) != 2 {
+			return "", errors.New("invalid api key")
+		}
+		key, ok := cameras.activeKey(parts[0])
+		if !ok || subtle.ConstantTimeCompare([]byte(key.SecretHash), []byte(hashSecret(parts[1]))) != 1 {
+			return "", errors.New("invalid api key")
+		}
+		return key.CameraUuid, nil
+	}
+
+	keyId := r.Header.Get("X-Camera-Key")
+	if keyId == "" {
+		return "", errors.New("missing camera credentials")
+	}
+	key, ok := cameras.activeKey(keyId)
+	if !ok {
+		return "", errInvalidCameraSignature
+	}
+
+	timestamp := r.Header.Get("X-Camera-Timestamp")
+	nonce := r.Header.Get("X-Camera-Nonce")
+	signature, err := hex.DecodeString(r.Header.Get("X-Camera-Signature"))
+	if err != nil || nonce == "" {
+		return "", errInvalidCameraSignature
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", errInvalidCameraSignature
+	}
+	skew := time.Since(time.Unix(seconds, 0))
+	if skew > cameraSignatureMaxSkew || skew < -cameraSignatureMaxSkew {
+		return "", errors.New("camera signature expired, check the clock of the camera")
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return "", err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	bodyHash := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, []byte(key.SecretHash))
+	mac.Write([]byte(strings.Join([]string{r.Method, r.URL.Path, timestamp, nonce, hex.EncodeToString(bodyHash[:])}, "\n")))
+	if !hmac.Equal(mac.Sum(nil), signature) {
+		return "", errInvalidCameraSignature
+	}
+
+	// only remember the nonce of valid signatures, or anyone could burn nonces
+	if !cameras.useNonce(key.Id, nonce) {
+		return "", errors.New("camera nonce was already used")
+	}
+	return key.CameraUuid, nil
+}
+
+// requireCameraCredentials only lets requests from authenticated cameras
+// through, the camera is available through getCurrentCamera
+func requireCameraCredentials(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !cameraCredentialsRequired {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cameraUuid, err := authenticateCamera(r)
+		if err != nil {
+			helpers.WriteErrorJsonStatus(w, r, http.StatusUnauthorized, err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), cameraContextKey, cameraUuid)))
+	})
+}
+
+// getCurrentCamera returns the camera that authenticated the request, or an
+// empty string when credentials aren't required
+func getCurrentCamera(r *http.Request) string {
+	cameraUuid, _ := r.Context().Value(cameraContextKey).(string)
+	return cameraUuid
+}
+
+// requireCameraAdmin only lets administrators of the organisation of the
+// camera in the path through, it has to come after RequireAuthentication
+var requireCameraAdmin = helpers.RequireOrganisationAdmin(func(r *http.Request) string {
+	cam, _ := cameras.get(chi.URLParam(r, "uuid"))
+	return cam.Organisation
+})
+
+func issueCameraKey(w http.ResponseWriter, r *http.Request) {
+	key, err := cameras.issueKey(chi.URLParam(r, "uuid"))
+	if err != nil {
+		helpers.WriteErrorJson(w, r, err)
+		return
+	}
+
+	helpers.WriteSuccessJson(w, r, key)
+}
+
+func getCameraKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := cameras.cameraKeys(chi.URLParam(r, "uuid"))
+	if err != nil {
+		helpers.WriteErrorJson(w, r, err)
+		return
+	}
+
+	helpers.WriteSuccessJson(w, r, keys)
+}
+
+func revokeCameraKey(w http.ResponseWriter, r *http.Request) {
+	err := cameras.revokeKey(chi.URLParam(r, "uuid"), chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.WriteErrorJson(w, r, err)
+		return
+	}
+
+	helpers.WriteSuccess(w, r)
+}
@@ -0,0 +1,142 @@
+package tracking
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signCameraRequest signs a request the way cameras do
+func signCameraRequest(r *http.Request, keyId, secret, nonce string, at time.Time, body string) {
+	secretHash := sha256.Sum256([]byte(secret))
+	bodyHash := sha256.Sum256([]byte(body))
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(hex.EncodeToString(secretHash[:])))
+	mac.Write([]byte(strings.Join([]string{r.Method, r.URL.Path, timestamp, nonce, hex.EncodeToString(bodyHash[:])}, "\n")))
+
+	r.Header.Set("X-Camera-Key", keyId)
+	r.Header.Set("X-Camera-Timestamp", timestamp)
+	r.Header.Set("X-Camera-Nonce", nonce)
+	r.Header.Set("X-Camera-Signature", hex.EncodeToString(mac.Sum(nil)))
+}
+
+func TestAuthenticateCamera(t *testing.T) {
+	oldCameras := cameras
+	defer func() { cameras = oldCameras }()
+	cameras = newCameraRegistry()
+
+	for _, uuid := range []string{"cam", "revoked"} {
+		if err := cameras.add(camera{Uuid: uuid, Name: uuid, Status: cameraActive}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key, err := cameras.issueKey("cam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := cameras.issueKey("revoked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cameras.revokeKey("revoked", revoked.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	if stored := cameras.keys[key.Id]; stored.Secret != "" || stored.SecretHash == "" {
+		t.Errorf("registry keeps %+v, want only the hash of the secret", stored)
+	}
+	if keys, _ := cameras.cameraKeys("cam"); len(keys) != 1 || keys[0].Secret != "" || keys[0].SecretHash != "" {
+		t.Errorf("cameraKeys() = %+v, want keys without secrets", keys)
+	}
+
+	const body = `[{"x":1,"y":2,"code":"o","camera":"cam"}]`
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		setup   func(r *http.Request)
+		want    string
+		wantErr bool
+	}{
+		{"no credentials", func(r *http.Request) {}, "", true},
+		{"api key", func(r *http.Request) { r.Header.Set("X-Api-Key", key.Id+"."+key.Secret) }, "cam", false},
+		{"api key with wrong secret", func(r *http.Request) { r.Header.Set("X-Api-Key", key.Id+".nope") }, "", true},
+		{"api key with the hash as secret", func(r *http.Request) {
+			r.Header.Set("X-Api-Key", key.Id+"."+cameras.keys[key.Id].SecretHash)
+		}, "", true},
+		{"revoked api key", func(r *http.Request) { r.Header.Set("X-Api-Key", revoked.Id+"."+revoked.Secret) }, "", true},
+		{"malformed api key", func(r *http.Request) { r.Header.Set("X-Api-Key", key.Secret) }, "", true},
+		{"signature", func(r *http.Request) { signCameraRequest(r, key.Id, key.Secret, "n1", now, body) }, "cam", false},
+		{"replayed nonce", func(r *http.Request) { signCameraRequest(r, key.Id, key.Secret, "n1", now, body) }, "", true},
+		{"signature with wrong secret", func(r *http.Request) { signCameraRequest(r, key.Id, "nope", "n2", now, body) }, "", true},
+		{"signature of another body", func(r *http.Request) { signCameraRequest(r, key.Id, key.Secret, "n3", now, "[]") }, "", true},
+		{"expired signature", func(r *http.Request) {
+			signCameraRequest(r, key.Id, key.Secret, "n4", now.Add(-2*cameraSignatureMaxSkew), body)
+		}, "", true},
+		{"signature from the future", func(r *http.Request) {
+			signCameraRequest(r, key.Id, key.Secret, "n5", now.Add(2*cameraSignatureMaxSkew), body)
+		}, "", true},
+		{"nonce of a rejected signature is not burnt", func(r *http.Request) {
+			signCameraRequest(r, key.Id, key.Secret, "n2", now, body)
+		}, "cam", false},
+		{"revoked signature key", func(r *http.Request) {
+			signCameraRequest(r, revoked.Id, revoked.Secret, "n6", now, body)
+		}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/v1/tracking/capture", strings.NewReader(body))
+			tt.setup(r)
+			got, err := authenticateCamera(r)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("authenticateCamera() = %q, %v, want %q, error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadCameraRegistryHashesSecrets(t *testing.T) {
+	oldFile, oldCameras := cameraRegistryFile, cameras
+	defer func() { cameraRegistryFile, cameras = oldFile, oldCameras }()
+
+	dir, err := ioutil.TempDir("", "cameras")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cameraRegistryFile = filepath.Join(dir, "cameras.json")
+
+	// as written before secrets were hashed
+	old := `{"cameras":{"cam":{"uuid":"cam","status":"active"}},"keys":{"ck_1":{"id":"ck_1","camera":"cam","secret":"s3cret"}}}`
+	if err := ioutil.WriteFile(cameraRegistryFile, []byte(old), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadCameraRegistry(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(cameraRegistryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "s3cret") {
+		t.Error("registry file still holds the secret")
+	}
+
+	r := httptest.NewRequest("POST", "/v1/tracking/capture", nil)
+	r.Header.Set("X-Api-Key", "ck_1.s3cret")
+	if got, err := authenticateCamera(r); err != nil || got != "cam" {
+		t.Errorf("authenticateCamera() = %q, %v with a migrated key", got, err)
+	}
+}
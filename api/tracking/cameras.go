@@ -0,0 +1,479 @@
+package tracking
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/acubed-tm/edge/helpers"
+	proto "github.com/acubed-tm/edge/protofiles"
+	"github.com/go-chi/chi"
+)
+
+// The camera registry is kept by the edge, in CAMERA_REGISTRY_FILE when set so
+// it survives restarts. With REQUIRE_REGISTERED_CAMERAS=true, captures from
+// cameras that aren't registered or were decommissioned are rejected; this
+// needs the registry file, or every camera would be rejected after a restart.
+// The file belongs to a single edge, replicas don't share registrations, so
+// production runs without it until the registry moves into the tracking
+// service. Last seen times and capture rates are only kept in memory.
+//
+// Cameras belong to an organisation: its members can see them and its
+// administrators manage them.
+
+const (
+	cameraActive         = "active"
+	cameraDecommissioned = "decommissioned"
+)
+
+// captures are counted over this window to get the capture rate
+const cameraRateWindow = 5 * time.Minute
+
+var (
+	cameraRegistryFile       = helpers.GetEnvString("CAMERA_REGISTRY_FILE", "")
+	requireRegisteredCameras = helpers.GetEnvBool("REQUIRE_REGISTERED_CAMERAS", false)
+)
+
+type cameraIntrinsics struct {
+	Fx         float64   `json:"fx"`
+	Fy         float64   `json:"fy"`
+	Cx         float64   `json:"cx"`
+	Cy         float64   `json:"cy"`
+	Distortion []float64 `json:"distortion,omitempty"`
+}
+
+type cameraExtrinsics struct {
+	Rotation    []float64 `json:"rotation"`    // 3x3, row major
+	Translation []float64 `json:"translation"` // x, y, z
+}
+
+type cameraCalibration struct {
+	Intrinsics *cameraIntrinsics `json:"intrinsics,omitempty"`
+	Extrinsics *cameraExtrinsics `json:"extrinsics,omitempty"`
+	Homography []float64         `json:"homography,omitempty"` // 3x3, row major, image to floor plane
+	Updated    time.Time         `json:"updated"`
+}
+
+func (c cameraCalibration) validate() error {
+	if c.Homography == nil && (c.Intrinsics == nil || c.Extrinsics == nil) {
+		return errors.New("calibration needs either intrinsics and extrinsics or a homography")
+	}
+	if c.Intrinsics != nil && (c.Intrinsics.Fx <= 0 || c.Intrinsics.Fy <= 0) {
+		return errors.New("focal lengths must be positive")
+	}
+	if c.Extrinsics != nil && (len(c.Extrinsics.Rotation) != 9 || len(c.Extrinsics.Translation) != 3) {
+		return errors.New("extrinsics need a 3x3 rotation and a translation of 3 values")
+	}
+	if c.Homography != nil {
+		h := c.Homography
+		if len(h) != 9 {
+			return errors.New("homography must have 9 values")
+		}
+		det := h[0]*(h[4]*h[8]-h[5]*h[7]) - h[1]*(h[3]*h[8]-h[5]*h[6]) + h[2]*(h[3]*h[7]-h[4]*h[6])
+		if math.Abs(det) < 1e-12 {
+			return errors.New("homography must be invertible")
+		}
+	}
+	return nil
+}
+
+type camera struct {
+	Uuid           string             `json:"uuid"`
+	Name           string             `json:"name"`
+	Organisation   string             `json:"organisation"`
+	Description    string             `json:"description"`
+	Status         string             `json:"status"`
+	Registered     time.Time          `json:"registered"`
+	Decommissioned *time.Time         `json:"decommissioned,omitempty"`
+	Calibration    *cameraCalibration `json:"calibration,omitempty"`
+
+	// filled in from the statistics when returned
+	LastSeen    int64   `json:"lastSeen"`    // ms epoch of the latest capture, 0 if never seen
+	CaptureRate float64 `json:"captureRate"` // captures per minute
+}
+
+type cameraStats struct {
+	LastSeen int64
+	// capture counts of recent batches, oldest first
+	batches []cameraBatch
+}
+
+type cameraBatch struct {
+	Received time.Time
+	Count    int
+}
+
+type cameraRegistry struct {
+	mu      sync.RWMutex
+	cameras map[string]camera
+	keys    map[string]cameraKey // key id -> key
+	stats   map[string]*cameraStats
+	nonces  map[string]time.Time // key id and nonce -> time it expires
+}
+
+// cameraRegistryContents is what's kept in CAMERA_REGISTRY_FILE
+type cameraRegistryContents struct {
+	Cameras map[string]camera    `json:"cameras"`
+	Keys    map[string]cameraKey `json:"keys"`
+}
+
+var cameras = newCameraRegistry()
+
+func newCameraRegistry() *cameraRegistry {
+	return &cameraRegistry{
+		cameras: map[string]camera{},
+		keys:    map[string]cameraKey{},
+		stats:   map[string]*cameraStats{},
+		nonces:  map[string]time.Time{},
+	}
+}
+
+// LoadCameraRegistry reads the registry from CAMERA_REGISTRY_FILE, it has to
+// be called before the routes are served
+func LoadCameraRegistry() error {
+	if cameraRegistryFile == "" {
+		if requireRegisteredCameras || cameraCredentialsRequired {
+			return errors.New("REQUIRE_REGISTERED_CAMERAS and REQUIRE_CAMERA_CREDENTIALS need CAMERA_REGISTRY_FILE")
+		}
+		log.Printf("CAMERA_REGISTRY_FILE is not set, registered cameras are lost on restart")
+		return nil
+	}
+
+	c := newCameraRegistry()
+	contents := cameraRegistryContents{Cameras: c.cameras, Keys: c.keys}
+	if err := helpers.LoadJsonFile(cameraRegistryFile, &contents); err != nil {
+		return fmt.Errorf("could not load camera registry: %w", err)
+	}
+	if contents.Cameras != nil {
+		c.cameras = contents.Cameras
+	}
+	if contents.Keys != nil {
+		c.keys = contents.Keys
+	}
+
+	// registries of earlier versions kept the secrets themselves
+	migrated := false
+	for id, key := range c.keys {
+		if key.Secret != "" {
+			key.SecretHash = hashSecret(key.Secret)
+			key.Secret = ""
+			c.keys[id] = key
+			migrated = true
+		}
+	}
+	if migrated {
+		if err := c.save(); err != nil {
+			return fmt.Errorf("could not save camera registry: %w", err)
+		}
+	}
+
+	cameras = c
+	return nil
+}
+
+// save must be called with the lock held
+func (c *cameraRegistry) save() error {
+	if cameraRegistryFile == "" {
+		return nil
+	}
+	return helpers.SaveJsonFile(cameraRegistryFile, cameraRegistryContents{Cameras: c.cameras, Keys: c.keys})
+}
+
+// withStats must be called with the (read) lock held
+func (c *cameraRegistry) withStats(cam camera) camera {
+	stats, ok := c.stats[cam.Uuid]
+	if !ok {
+		return cam
+	}
+	cam.LastSeen = stats.LastSeen
+
+	count := 0
+	since := time.Now().Add(-cameraRateWindow)
+	for _, b := range stats.batches {
+		if b.Received.After(since) {
+			count += b.Count
+		}
+	}
+	cam.CaptureRate = float64(count) / cameraRateWindow.Minutes()
+	return cam
+}
+
+func (c *cameraRegistry) all() []camera {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ret := make([]camera, 0, len(c.cameras))
+	for _, cam := range c.cameras {
+		ret = append(ret, c.withStats(cam))
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+func (c *cameraRegistry) get(uuid string) (camera, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	cam, ok := c.cameras[uuid]
+	return c.withStats(cam), ok
+}
+
+// update changes a camera and saves the registry
+func (c *cameraRegistry) update(uuid string, f func(cam *camera) error) (camera, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cam, ok := c.cameras[uuid]
+	if !ok {
+		return camera{}, errCameraNotFound
+	}
+	if err := f(&cam); err != nil {
+		return camera{}, err
+	}
+	old := c.cameras[uuid]
+	c.cameras[uuid] = cam
+	if err := c.save(); err != nil {
+		c.cameras[uuid] = old
+		return camera{}, err
+	}
+	return c.withStats(cam), nil
+}
+
+func (c *cameraRegistry) add(cam camera) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.cameras[cam.Uuid]; ok {
+		return errors.New("camera is already registered")
+	}
+	c.cameras[cam.Uuid] = cam
+	if err := c.save(); err != nil {
+		delete(c.cameras, cam.Uuid)
+		return err
+	}
+	return nil
+}
+
+// checkCaptures rejects captures from cameras that may not send them, and for
+// other cameras than the one that authenticated the request, if any
+func (c *cameraRegistry) checkCaptures(captures []*proto.AddCaptureRequest, authenticated string) error {
+	for _, capture := range captures {
+		if authenticated != "" && capture.CameraUuid != authenticated {
+			return fmt.Errorf("credentials are not valid for camera %s", capture.CameraUuid)
+		}
+	}
+
+	if !requireRegisteredCameras {
+		return nil
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, capture := range captures {
+		cam, ok := c.cameras[capture.CameraUuid]
+		if !ok {
+			return fmt.Errorf("camera %s is not registered", capture.CameraUuid)
+		}
+		if cam.Status != cameraActive {
+			return fmt.Errorf("camera %s is decommissioned", capture.CameraUuid)
+		}
+	}
+	return nil
+}
+
+// recordCaptures updates the statistics of the cameras that sent the captures
+func (c *cameraRegistry) recordCaptures(captures []*proto.AddCaptureRequest) {
+	counts := map[string]int{}
+	latest := map[string]int64{}
+	for _, capture := range captures {
+		counts[capture.CameraUuid]++
+		if capture.Time > latest[capture.CameraUuid] {
+			latest[capture.CameraUuid] = capture.Time
+		}
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for uuid, count := range counts {
+		stats, ok := c.stats[uuid]
+		if !ok {
+			stats = &cameraStats{}
+			c.stats[uuid] = stats
+		}
+		if latest[uuid] > stats.LastSeen {
+			stats.LastSeen = latest[uuid]
+		}
+
+		// drop batches that fell out of the window
+		i := 0
+		for i < len(stats.batches) && now.Sub(stats.batches[i].Received) > cameraRateWindow {
+			i++
+		}
+		stats.batches = append(stats.batches[i:], cameraBatch{Received: now, Count: count})
+	}
+}
+
+var (
+	errCameraNotFound           = errors.New("camera not found")
+	errNotCameraAdmin           = errors.New("only administrators of the organisation can do this")
+	errCameraOrganisationChange = errors.New("only administrators of the edge can move a camera to another organisation")
+)
+
+type cameraFields struct {
+	Name         string `json:"name"`
+	Organisation string `json:"organisation"`
+	Description  string `json:"description"`
+}
+
+func (f cameraFields) validate() error {
+	if f.Name == "" || f.Organisation == "" {
+		return errors.New("name and organisation are required")
+	}
+	return nil
+}
+
+func getCameras(w http.ResponseWriter, r *http.Request) {
+	ret := []camera{}
+	for _, cam := range cameras.all() {
+		if helpers.IsOrganisationMember(r, cam.Organisation) {
+			ret = append(ret, cam)
+		}
+	}
+	helpers.WriteSuccessJson(w, r, ret)
+}
+
+func getCamera(w http.ResponseWriter, r *http.Request) {
+	cam, ok := cameras.get(chi.URLParam(r, "uuid"))
+	// cameras of other organisations are not found, rather than forbidden
+	if !ok || !helpers.IsOrganisationMember(r, cam.Organisation) {
+		helpers.WriteErrorJson(w, r, errCameraNotFound)
+		return
+	}
+
+	helpers.WriteSuccessJson(w, r, cam)
+}
+
+func registerCamera(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Uuid string `json:"uuid"` // as configured on the camera, generated when left empty
+		cameraFields
+	}
+
+	err := helpers.GetJsonFromRequestBody(r, &req)
+	if err != nil {
+		helpers.WriteErrorJson(w, r, err)
+		return
+	}
+
+	if err := req.validate(); err != nil {
+		helpers.WriteErrorJson(w, r, err)
+		return
+	}
+	if !helpers.IsOrganisationAdmin(r, req.Organisation) {
+		helpers.WriteErrorJsonStatus(w, r, http.StatusForbidden, errNotCameraAdmin)
+		return
+	}
+	if req.Uuid == "" {
+		req.Uuid = helpers.NewUuid()
+	}
+
+	cam := camera{
+		Uuid:         req.Uuid,
+		Name:         req.Name,
+		Organisation: req.Organisation,
+		Description:  req.Description,
+		Status:       cameraActive,
+		Registered:   time.Now().UTC(),
+	}
+	if err := cameras.add(cam); err != nil {
+		helpers.WriteErrorJson(w, r, err)
+		return
+	}
+
+	helpers.WriteSuccessJson(w, r, cam)
+}
+
+func updateCamera(w http.ResponseWriter, r *http.Request) {
+	var req cameraFields
+
+	err := helpers.GetJsonFromRequestBody(r, &req)
+	if err != nil {
+		helpers.WriteErrorJson(w, r, err)
+		return
+	}
+
+	if err := req.validate(); err != nil {
+		helpers.WriteErrorJson(w, r, err)
+		return
+	}
+
+	// checked again under the lock, the camera may have moved since requireCameraAdmin
+	cam, err := cameras.update(chi.URLParam(r, "uuid"), func(cam *camera) error {
+		if !helpers.IsOrganisationAdmin(r, cam.Organisation) {
+			return errNotCameraAdmin
+		}
+		if req.Organisation != cam.Organisation && !helpers.IsAdmin(r) {
+			return errCameraOrganisationChange
+		}
+		cam.Name = req.Name
+		cam.Organisation = req.Organisation
+		cam.Description = req.Description
+		return nil
+	})
+	if errors.Is(err, errNotCameraAdmin) || errors.Is(err, errCameraOrganisationChange) {
+		helpers.WriteErrorJsonStatus(w, r, http.StatusForbidden, err)
+		return
+	}
+	if err != nil {
+		helpers.WriteErrorJson(w, r, err)
+		return
+	}
+
+	helpers.WriteSuccessJson(w, r, cam)
+}
+
+func decommissionCamera(w http.ResponseWriter, r *http.Request) {
+	cam, err := cameras.update(chi.URLParam(r, "uuid"), func(cam *camera) error {
+		if cam.Status == cameraDecommissioned {
+			return errors.New("camera is already decommissioned")
+		}
+		now := time.Now().UTC()
+		cam.Status = cameraDecommissioned
+		cam.Decommissioned = &now
+		return nil
+	})
+	if err != nil {
+		helpers.WriteErrorJson(w, r, err)
+		return
+	}
+
+	helpers.WriteSuccessJson(w, r, cam)
+}
+
+func updateCameraCalibration(w http.ResponseWriter, r *http.Request) {
+	var req cameraCalibration
+
+	err := helpers.GetJsonFromRequestBody(r, &req)
+	if err != nil {
+		helpers.WriteErrorJson(w, r, err)
+		return
+	}
+
+	if err := req.validate(); err != nil {
+		helpers.WriteErrorJson(w, r, err)
+		return
+	}
+	req.Updated = time.Now().UTC()
+
+	cam, err := cameras.update(chi.URLParam(r, "uuid"), func(cam *camera) error {
+		cam.Calibration = &req
+		return nil
+	})
+	if err != nil {
+		helpers.WriteErrorJson(w, r, err)
+		return
+	}
+
+	helpers.WriteSuccessJson(w, r, cam)
+}
@@ -0,0 +1,54 @@
+package tracking
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	proto "github.com/acubed-tm/edge/protofiles"
+)
+
+func TestLoadCameraRegistry(t *testing.T) {
+	oldFile, oldRequire, oldCameras := cameraRegistryFile, requireRegisteredCameras, cameras
+	defer func() { cameraRegistryFile, requireRegisteredCameras, cameras = oldFile, oldRequire, oldCameras }()
+
+	cameraRegistryFile, requireRegisteredCameras = "", true
+	if err := LoadCameraRegistry(); err == nil {
+		t.Error("LoadCameraRegistry() enforced registration without a registry file")
+	}
+
+	dir, err := ioutil.TempDir("", "cameras")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cameraRegistryFile = filepath.Join(dir, "cameras.json")
+
+	// a missing file is an empty registry
+	if err := LoadCameraRegistry(); err != nil {
+		t.Fatalf("LoadCameraRegistry() error = %v", err)
+	}
+	if err := cameras.add(camera{Uuid: "c", Name: "c", Status: cameraActive, Registered: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	cameras = newCameraRegistry()
+	if err := LoadCameraRegistry(); err != nil {
+		t.Fatalf("LoadCameraRegistry() error = %v", err)
+	}
+	if err := cameras.checkCaptures([]*proto.AddCaptureRequest{{CameraUuid: "c"}}, ""); err != nil {
+		t.Errorf("registered camera was rejected after loading: %v", err)
+	}
+	if err := cameras.checkCaptures([]*proto.AddCaptureRequest{{CameraUuid: "other"}}, ""); err == nil {
+		t.Error("unregistered camera was accepted")
+	}
+
+	if err := ioutil.WriteFile(cameraRegistryFile, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadCameraRegistry(); err == nil {
+		t.Error("LoadCameraRegistry() accepted a broken file")
+	}
+}
@@ -0,0 +1,255 @@
+package tracking
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	proto "github.com/acubed-tm/edge/protofiles"
+)
+
+// Capture payloads are versioned so the format can change without breaking
+// cameras that are already deployed. The version is taken from the media type
+// (eg. application/vnd.acubed.capture.v2+json) and otherwise from the
+// "version" field of the payload. A bare JSON array is always version 1.
+// Protobuf payloads (see capture.proto) go through the same pipeline.
+
+const captureMediaTypePrefix = "application/vnd.acubed.capture."
+
+// maximum size of a capture request body, in any encoding
+const maxCaptureBodySize = 8 << 20
+
+// capture is the edge representation of a single capture, independent of the
+// payload version or encoding it was received in
+type capture struct {
+	Version     int
+	CaptureX    *float32
+	CaptureY    *float32
+	Time        int64
+	ObjectUuid  string
+	CameraUuid  string
+	Confidence  *float32
+	BoundingBox *captureBox
+	FrameId     string
+}
+
+type captureBox struct {
+	X      float32 `json:"x"`
+	Y      float32 `json:"y"`
+	Width  float32 `json:"width"`
+	Height float32 `json:"height"`
+}
+
+// captureDecoder decodes the body of one JSON payload version
+type captureDecoder func(body []byte) ([]capture, error)
+
+var captureDecoders = map[int]captureDecoder{
+	1: decodeCaptureV1,
+	2: decodeCaptureV2,
+}
+
+var errUnsupportedCaptureVersion = errors.New("unsupported capture payload version")
+
+// limitCaptureBody refuses capture bodies larger than maxCaptureBodySize. It
+// goes before the camera credentials, which read the body to check signatures.
+func limitCaptureBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxCaptureBodySize)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// decodeCaptures reads the request body in whatever format the camera sent it
+// and turns it into validated tracking service requests
+func decodeCaptures(r *http.Request) ([]*proto.AddCaptureRequest, error) {
+	var captures []capture
+
+	mediaType, params, err := parseContentType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+
+	if mediaType == protobufMediaType {
+		captures, err = decodeCaptureProto(r.Body, params["delimited"] == "true")
+	} else {
+		captures, err = decodeCaptureJson(mediaType, r)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*proto.AddCaptureRequest, len(captures))
+	for i, c := range captures {
+		ret[i], err = c.toRequest()
+		if err != nil {
+			return nil, fmt.Errorf("capture %d: %w", i, err)
+		}
+	}
+	return ret, nil
+}
+
+func parseContentType(contentType string) (string, map[string]string, error) {
+	if contentType == "" {
+		return "", nil, nil
+	}
+	return mime.ParseMediaType(contentType)
+}
+
+func decodeCaptureJson(mediaType string, r *http.Request) ([]capture, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := captureVersion(mediaType, body)
+	if err != nil {
+		return nil, err
+	}
+
+	decode, ok := captureDecoders[version]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", errUnsupportedCaptureVersion, version)
+	}
+	return decode(body)
+}
+
+func captureVersion(mediaType string, body []byte) (int, error) {
+	if strings.HasPrefix(mediaType, captureMediaTypePrefix) {
+		v := strings.TrimSuffix(strings.TrimPrefix(mediaType, captureMediaTypePrefix), "+json")
+		version, err := strconv.Atoi(strings.TrimPrefix(v, "v"))
+		if err != nil || !strings.HasPrefix(v, "v") {
+			return 0, fmt.Errorf("%w: %s", errUnsupportedCaptureVersion, mediaType)
+		}
+		return version, nil
+	}
+
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		return 1, nil
+	}
+
+	var envelope struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return 0, err
+	}
+	if envelope.Version == 0 {
+		return 0, errors.New("capture payload has no version")
+	}
+	return envelope.Version, nil
+}
+
+// toRequest validates the capture and maps it to a tracking service request
+func (c capture) toRequest() (*proto.AddCaptureRequest, error) {
+	// version 1 never required these, and cameras that leave them out are still deployed
+	if c.Version >= 2 && (c.ObjectUuid == "" || c.CameraUuid == "") {
+		return nil, errors.New("code and camera are required")
+	}
+	if c.Confidence != nil && (*c.Confidence < 0 || *c.Confidence > 1) {
+		return nil, errors.New("confidence must be between 0 and 1")
+	}
+
+	var x, y float32
+	switch {
+	case c.CaptureX != nil && c.CaptureY != nil:
+		x, y = *c.CaptureX, *c.CaptureY
+	case c.BoundingBox != nil:
+		// use the center of the box when no explicit position is given
+		x = c.BoundingBox.X + c.BoundingBox.Width/2
+		y = c.BoundingBox.Y + c.BoundingBox.Height/2
+	default:
+		return nil, errors.New("either x and y or box is required")
+	}
+
+	// confidence and frame id are validated but not forwarded: AddCaptureRequest
+	// has no fields for them yet (see the README)
+	return &proto.AddCaptureRequest{
+		CaptureX:   x,
+		CaptureY:   y,
+		Time:       normalizeCaptureTime(c.Time),
+		ObjectUuid: c.ObjectUuid,
+		CameraUuid: c.CameraUuid,
+	}, nil
+}
+
+// ensure ms epochs, older cameras send seconds
+func normalizeCaptureTime(t int64) int64 {
+	if t < 1500000000000 {
+		return t * 1000
+	}
+	return t
+}
+
+func decodeCaptureV1(body []byte) ([]capture, error) {
+	var req []struct {
+		CaptureX   float32 `json:"x"`
+		CaptureY   float32 `json:"y"`
+		Time       int64   `json:"time"`
+		ObjectUuid string  `json:"code"`
+		CameraUuid string  `json:"camera"`
+	}
+
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+
+	ret := make([]capture, len(req))
+	for i := range req {
+		e := req[i]
+		ret[i] = capture{
+			Version:    1,
+			CaptureX:   &e.CaptureX,
+			CaptureY:   &e.CaptureY,
+			Time:       e.Time,
+			ObjectUuid: e.ObjectUuid,
+			CameraUuid: e.CameraUuid,
+		}
+	}
+	return ret, nil
+}
+
+func decodeCaptureV2(body []byte) ([]capture, error) {
+	var req struct {
+		Version  int `json:"version"`
+		Captures []struct {
+			CaptureX    *float32    `json:"x"`
+			CaptureY    *float32    `json:"y"`
+			Time        int64       `json:"time"`
+			ObjectUuid  string      `json:"code"`
+			CameraUuid  string      `json:"camera"`
+			Confidence  *float32    `json:"confidence"`
+			BoundingBox *captureBox `json:"box"`
+			FrameId     string      `json:"frame"`
+		} `json:"captures"`
+	}
+
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+	if req.Version != 0 && req.Version != 2 {
+		return nil, fmt.Errorf("%w: payload says %d but was sent as 2", errUnsupportedCaptureVersion, req.Version)
+	}
+
+	ret := make([]capture, len(req.Captures))
+	for i, e := range req.Captures {
+		ret[i] = capture{
+			Version:     2,
+			CaptureX:    e.CaptureX,
+			CaptureY:    e.CaptureY,
+			Time:        e.Time,
+			ObjectUuid:  e.ObjectUuid,
+			CameraUuid:  e.CameraUuid,
+			Confidence:  e.Confidence,
+			BoundingBox: e.BoundingBox,
+			FrameId:     e.FrameId,
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,123 @@
+package tracking
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	protobuf "github.com/golang/protobuf/proto"
+)
+
+const protobufMediaType = "application/x-protobuf"
+
+// maximum size of a single message in a delimited stream
+const maxCaptureMessageSize = 1 << 20
+
+// The message types below mirror capture.proto. They are kept by hand rather
+// than generated so the edge does not need protoc to build.
+
+type boundingBoxMessage struct {
+	X      float32 `protobuf:"fixed32,1,opt,name=x,proto3"`
+	Y      float32 `protobuf:"fixed32,2,opt,name=y,proto3"`
+	Width  float32 `protobuf:"fixed32,3,opt,name=width,proto3"`
+	Height float32 `protobuf:"fixed32,4,opt,name=height,proto3"`
+}
+
+func (m *boundingBoxMessage) Reset()         { *m = boundingBoxMessage{} }
+func (m *boundingBoxMessage) String() string { return protobuf.CompactTextString(m) }
+func (*boundingBoxMessage) ProtoMessage()    {}
+
+type captureMessage struct {
+	X          float32             `protobuf:"fixed32,1,opt,name=x,proto3"`
+	Y          float32             `protobuf:"fixed32,2,opt,name=y,proto3"`
+	Time       int64               `protobuf:"varint,3,opt,name=time,proto3"`
+	Code       string              `protobuf:"bytes,4,opt,name=code,proto3"`
+	Camera     string              `protobuf:"bytes,5,opt,name=camera,proto3"`
+	Confidence float32             `protobuf:"fixed32,6,opt,name=confidence,proto3"`
+	Box        *boundingBoxMessage `protobuf:"bytes,7,opt,name=box,proto3"`
+	Frame      string              `protobuf:"bytes,8,opt,name=frame,proto3"`
+}
+
+func (m *captureMessage) Reset()         { *m = captureMessage{} }
+func (m *captureMessage) String() string { return protobuf.CompactTextString(m) }
+func (*captureMessage) ProtoMessage()    {}
+
+type captureBatchMessage struct {
+	Captures []*captureMessage `protobuf:"bytes,1,rep,name=captures,proto3"`
+}
+
+func (m *captureBatchMessage) Reset()         { *m = captureBatchMessage{} }
+func (m *captureBatchMessage) String() string { return protobuf.CompactTextString(m) }
+func (*captureBatchMessage) ProtoMessage()    {}
+
+func (m *captureMessage) toCapture() capture {
+	ret := capture{
+		Version:    2,
+		Time:       m.Time,
+		ObjectUuid: m.Code,
+		CameraUuid: m.Camera,
+		FrameId:    m.Frame,
+	}
+	if m.Box == nil || m.X != 0 || m.Y != 0 {
+		x, y := m.X, m.Y
+		ret.CaptureX, ret.CaptureY = &x, &y
+	}
+	if m.Box != nil {
+		ret.BoundingBox = &captureBox{X: m.Box.X, Y: m.Box.Y, Width: m.Box.Width, Height: m.Box.Height}
+	}
+	if m.Confidence != 0 {
+		confidence := m.Confidence
+		ret.Confidence = &confidence
+	}
+	return ret
+}
+
+// decodeCaptureProto reads either a single CaptureBatch or, when delimited is
+// set, a stream of length-prefixed Capture messages
+func decodeCaptureProto(body io.Reader, delimited bool) ([]capture, error) {
+	if !delimited {
+		bodyBytes, err := ioutil.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+
+		var batch captureBatchMessage
+		if err := protobuf.Unmarshal(bodyBytes, &batch); err != nil {
+			return nil, err
+		}
+
+		ret := make([]capture, len(batch.Captures))
+		for i, m := range batch.Captures {
+			ret[i] = m.toCapture()
+		}
+		return ret, nil
+	}
+
+	var ret []capture
+	reader := bufio.NewReader(body)
+	for {
+		size, err := binary.ReadUvarint(reader)
+		if err == io.EOF {
+			return ret, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if size > maxCaptureMessageSize {
+			return nil, errors.New("capture message too large")
+		}
+
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+
+		var m captureMessage
+		if err := protobuf.Unmarshal(buf, &m); err != nil {
+			return nil, err
+		}
+		ret = append(ret, m.toCapture())
+	}
+}
@@ -0,0 +1,136 @@
+package tracking
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/acubed-tm/edge/helpers"
+	proto "github.com/acubed-tm/edge/protofiles"
+	protobuf "github.com/golang/protobuf/proto"
+)
+
+func TestDecodeCaptures(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantErr     bool
+	}{
+		{"v1", "application/json", `[{"x":1,"y":2,"time":1,"code":"o","camera":"c"}]`, false},
+		{"v1 without code and camera", "application/json", `[{"x":1,"y":2,"time":1}]`, false},
+		{"v2", captureMediaTypePrefix + "v2+json", `{"captures":[{"x":1,"y":2,"code":"o","camera":"c"}]}`, false},
+		{"v2 without camera", captureMediaTypePrefix + "v2+json", `{"captures":[{"x":1,"y":2,"code":"o"}]}`, true},
+		{"v2 with box", "application/json", `{"version":2,"captures":[{"box":{"x":0,"y":0,"width":2,"height":2},"code":"o","camera":"c"}]}`, false},
+		{"v2 without position", "application/json", `{"version":2,"captures":[{"code":"o","camera":"c"}]}`, true},
+		{"unknown version", captureMediaTypePrefix + "v9+json", `{}`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/capture", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			_, err := decodeCaptures(r)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("decodeCaptures() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func marshalCapture(t *testing.T, m *captureMessage) []byte {
+	b, err := protobuf.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// delimitCaptures writes the messages as a varint length-prefixed stream
+func delimitCaptures(t *testing.T, messages ...*captureMessage) []byte {
+	var buf bytes.Buffer
+	for _, m := range messages {
+		b := marshalCapture(t, m)
+		size := make([]byte, binary.MaxVarintLen64)
+		buf.Write(size[:binary.PutUvarint(size, uint64(len(b)))])
+		buf.Write(b)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeCaptureProto(t *testing.T) {
+	// the fields a version 1 camera sends, and a version 2 capture positioned by its box
+	v1 := &captureMessage{X: 1, Y: 2, Time: 1500000000, Code: "o", Camera: "c"}
+	v2 := &captureMessage{Time: 1500000000001, Code: "o", Camera: "c", Confidence: 0.5, Frame: "f",
+		Box: &boundingBoxMessage{X: 2, Y: 4, Width: 2, Height: 4}}
+
+	batch, err := protobuf.Marshal(&captureBatchMessage{Captures: []*captureMessage{v1, v2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := delimitCaptures(t, v1, v2)
+	tooLarge := make([]byte, binary.MaxVarintLen64)
+	tooLarge = tooLarge[:binary.PutUvarint(tooLarge, maxCaptureMessageSize+1)]
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		wantErr     bool
+	}{
+		{"batch", protobufMediaType, batch, false},
+		{"delimited stream", protobufMediaType + "; delimited=true", stream, false},
+		{"truncated stream", protobufMediaType + "; delimited=true", stream[:len(stream)-1], true},
+		{"message too large", protobufMediaType + "; delimited=true", tooLarge, true},
+		{"stream sent as a batch", protobufMediaType, stream, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/capture", bytes.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			got, err := decodeCaptures(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeCaptures() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			want := []*proto.AddCaptureRequest{
+				{CaptureX: 1, CaptureY: 2, Time: 1500000000000, ObjectUuid: "o", CameraUuid: "c"},
+				{CaptureX: 3, CaptureY: 6, Time: 1500000000001, ObjectUuid: "o", CameraUuid: "c"},
+			}
+			if len(got) != len(want) {
+				t.Fatalf("decoded %d captures, want %d", len(got), len(want))
+			}
+			for i, w := range want {
+				g := got[i]
+				if g.CaptureX != w.CaptureX || g.CaptureY != w.CaptureY || g.Time != w.Time ||
+					g.ObjectUuid != w.ObjectUuid || g.CameraUuid != w.CameraUuid {
+					t.Errorf("capture %d = %v, want %v", i, got[i], want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLimitCaptureBody(t *testing.T) {
+	h := limitCaptureBody(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := decodeCaptures(r); err != nil {
+			helpers.WriteErrorJsonStatus(w, r, http.StatusRequestEntityTooLarge, err)
+		}
+	}))
+
+	stream := delimitCaptures(t, &captureMessage{X: 1, Y: 2, Code: "o", Camera: "c"})
+	body := bytes.Repeat(stream, maxCaptureBodySize/len(stream)+1)
+	r := httptest.NewRequest("POST", "/capture", bytes.NewReader(body))
+	r.Header.Set("Content-Type", protobufMediaType+"; delimited=true")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
@@ -0,0 +1,81 @@
+package tracking
+
+import (
+	"sync"
+	"time"
+
+	"github.com/acubed-tm/edge/api/webhooks"
+	"github.com/acubed-tm/edge/helpers"
+	proto "github.com/acubed-tm/edge/protofiles"
+)
+
+// objects that weren't captured for this long cause an object.reappeared event
+var reappearGap = helpers.GetEnvDuration("WEBHOOK_REAPPEAR_GAP", 5*time.Minute)
+
+var lastCaptured = struct {
+	sync.Mutex
+	times map[string]int64 // object uuid -> ms epoch of the latest capture
+}{times: map[string]int64{}}
+
+// publishCaptures sends the webhook events of a forwarded capture batch
+func publishCaptures(captures []*proto.AddCaptureRequest) {
+	type reappeared struct {
+		ObjectUuid string `json:"object"`
+		CameraUuid string `json:"camera"`
+		Time       int64  `json:"time"`
+		LastSeen   int64  `json:"lastSeen"`
+	}
+	var events []reappeared
+
+	lastCaptured.Lock()
+	for _, c := range captures {
+		last, ok := lastCaptured.times[c.ObjectUuid]
+		if ok && c.Time-last >= reappearGap.Milliseconds() {
+			events = append(events, reappeared{ObjectUuid: c.ObjectUuid, CameraUuid: c.CameraUuid, Time: c.Time, LastSeen: last})
+		}
+		if c.Time > last {
+			lastCaptured.times[c.ObjectUuid] = c.Time
+		}
+	}
+	lastCaptured.Unlock()
+
+	for _, e := range events {
+		webhooks.Publish(cameraOrganisation(e.CameraUuid), webhooks.ObjectReappeared, e)
+	}
+
+	// every organisation hears about the captures of its own cameras
+	type received struct {
+		Count   int      `json:"count"`
+		Objects []string `json:"objects"`
+	}
+	var organisations []string
+	byOrganisation := map[string]*received{}
+	seen := map[string]bool{}
+	for _, c := range captures {
+		organisation := cameraOrganisation(c.CameraUuid)
+		e, ok := byOrganisation[organisation]
+		if !ok {
+			e = &received{}
+			byOrganisation[organisation] = e
+			organisations = append(organisations, organisation)
+		}
+		e.Count++
+		if !seen[organisation+"\n"+c.ObjectUuid] {
+			seen[organisation+"\n"+c.ObjectUuid] = true
+			e.Objects = append(e.Objects, c.ObjectUuid)
+		}
+	}
+	for _, organisation := range organisations {
+		webhooks.Publish(organisation, webhooks.CaptureReceived, byOrganisation[organisation])
+	}
+}
+
+// cameraOrganisation returns the organisation of a registered camera, or
+// AllOrganisations for captures of cameras the edge doesn't know
+func cameraOrganisation(cameraUuid string) string {
+	cam, ok := cameras.get(cameraUuid)
+	if !ok || cam.Organisation == "" {
+		return webhooks.AllOrganisations
+	}
+	return cam.Organisation
+}
@@ -0,0 +1,387 @@
+package tracking
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/acubed-tm/edge/helpers"
+)
+
+// Trajectories are exported with GET /export, taking these query parameters
+// on top of the ones of GET /object/{uuid} (limit and cursor are ignored):
+//
+//	objects    comma separated object uuids, all objects when left out
+//	format     geojson, csv or gpx, geojson by default when the transform is
+//	           geo-referenced and csv otherwise
+//	geometry   line (default) or points, only used for geojson
+//	transform  coordinate transform, see parseTransform
+//
+// GeoJSON and GPX hold longitude and latitude, so they need a geo transform;
+// local coordinates can only be exported as csv. Objects are fetched and
+// written one at a time, each with a call of its own to the tracking service,
+// so only one history is held in memory. GetObject has no time range, so the
+// range is applied here after fetching the whole history of an object.
+
+const exportTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// coordinateTransform maps local x/y/z to the reference frame of the export
+type coordinateTransform func(l objectLocation) (float64, float64, float64)
+
+func identityTransform(l objectLocation) (float64, float64, float64) {
+	return l.X, l.Y, l.Z
+}
+
+// parseTransform reads a transform in one of these forms, falling back on the
+// EXPORT_TRANSFORM environment variable and then on the identity transform:
+//
+//	affine:a,b,c,d,e,f,g,h,i,j,k,l  x' = ax+by+cz+d, y' = ex+fy+gz+h, z' = ix+jy+kz+l
+//	geo:lat,lon,alt,heading         local meters to lon/lat/alt, with the y axis
+//	                                pointing heading degrees clockwise from north
+//
+// geo is true when the transform results in longitude and latitude.
+func parseTransform(s string) (t coordinateTransform, geo bool, err error) {
+	if s == "" {
+		s = os.Getenv("EXPORT_TRANSFORM")
+	}
+	if s == "" {
+		return identityTransform, false, nil
+	}
+
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return nil, false, errors.New("transform must look like affine:... or geo:...")
+	}
+
+	var values []float64
+	for _, v := range strings.Split(parts[1], ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid transform value %q", v)
+		}
+		values = append(values, f)
+	}
+
+	switch parts[0] {
+	case "affine":
+		if len(values) != 12 {
+			return nil, false, errors.New("affine transform needs 12 values")
+		}
+		m := values
+		return func(l objectLocation) (float64, float64, float64) {
+			return m[0]*l.X + m[1]*l.Y + m[2]*l.Z + m[3],
+				m[4]*l.X + m[5]*l.Y + m[6]*l.Z + m[7],
+				m[8]*l.X + m[9]*l.Y + m[10]*l.Z + m[11]
+		}, false, nil
+	case "geo":
+		if len(values) != 4 {
+			return nil, false, errors.New("geo transform needs lat, lon, alt and heading")
+		}
+		const earthRadius = 6378137.0
+		lat, lon, alt := values[0], values[1], values[2]
+		heading := values[3] * math.Pi / 180
+		metersPerLat := earthRadius * math.Pi / 180
+		metersPerLon := metersPerLat * math.Cos(lat*math.Pi/180)
+		return func(l objectLocation) (float64, float64, float64) {
+			east := l.X*math.Cos(heading) + l.Y*math.Sin(heading)
+			north := -l.X*math.Sin(heading) + l.Y*math.Cos(heading)
+			return lon + east/metersPerLon, lat + north/metersPerLat, alt + l.Z
+		}, true, nil
+	default:
+		return nil, false, fmt.Errorf("unknown transform %q", parts[0])
+	}
+}
+
+// trajectoryWriter writes the trajectories of one or more objects in an export format
+type trajectoryWriter interface {
+	contentType() string
+	extension() string
+	begin() error
+	object(uuid string, locations []objectLocation) error
+	end() error
+}
+
+func newTrajectoryWriter(w io.Writer, format, geometry string, t coordinateTransform, geo bool) (trajectoryWriter, error) {
+	if format == "" && !geo {
+		format = "csv"
+	}
+	if (format == "" || format == "geojson" || format == "gpx") && !geo {
+		return nil, errors.New("geojson and gpx exports need a geo transform, use csv for local coordinates")
+	}
+
+	switch format {
+	case "", "geojson":
+		if geometry != "" && geometry != "line" && geometry != "points" {
+			return nil, errors.New("geometry must be either line or points")
+		}
+		return &geoJsonWriter{w: w, t: t, points: geometry == "points"}, nil
+	case "csv":
+		return &csvWriter{w: csv.NewWriter(w), t: t}, nil
+	case "gpx":
+		return &gpxWriter{w: w, t: t}, nil
+	default:
+		return nil, errors.New("format must be one of geojson, csv or gpx")
+	}
+}
+
+func exportTrajectories(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+
+	query, err := parseHistoryQuery(values)
+	if err != nil {
+		helpers.WriteErrorJson(w, r, err)
+		return
+	}
+	query.Limit, query.Cursor = 0, nil
+
+	transform, geo, err := parseTransform(values.Get("transform"))
+	if err != nil {
+		helpers.WriteErrorJson(w, r, err)
+		return
+	}
+
+	tw, err := newTrajectoryWriter(w, values.Get("format"), values.Get("geometry"), transform, geo)
+	if err != nil {
+		helpers.WriteErrorJson(w, r, err)
+		return
+	}
+
+	var uuids []string
+	if v := values.Get("objects"); v != "" {
+		uuids = strings.Split(v, ",")
+	} else {
+		objects, _, err := getObjectInfos(false)
+		if err != nil {
+			helpers.WriteErrorJson(w, r, err)
+			return
+		}
+		for _, o := range objects {
+			uuids = append(uuids, o.Uuid)
+		}
+	}
+
+	// fetch the first history before sending headers, so a failing upstream
+	// still gets a proper error response
+	var first []objectLocation
+	if len(uuids) > 0 {
+		if first, err = readObjectLocations(uuids[0]); err != nil {
+			helpers.WriteErrorJson(w, r, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", tw.contentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"trajectories.%s\"", tw.extension()))
+	if err := tw.begin(); err != nil {
+		log.Printf("Aborting export after error: %v", err)
+		return
+	}
+
+	for i, uuid := range uuids {
+		locations := first
+		if i > 0 {
+			if locations, err = readObjectLocations(uuid); err != nil {
+				// headers are already sent, all we can do is cut the export short
+				log.Printf("Aborting export after error: %v", err)
+				return
+			}
+		}
+		page, _ := query.apply(locations)
+		if err := tw.object(uuid, page); err != nil {
+			log.Printf("Aborting export after error: %v", err)
+			return
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+
+	if err := tw.end(); err != nil {
+		log.Printf("Aborting export after error: %v", err)
+	}
+}
+
+func formatExportTime(ms int64) string {
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC().Format(exportTimeFormat)
+}
+
+type geoJsonWriter struct {
+	w      io.Writer
+	t      coordinateTransform
+	points bool
+	count  int
+}
+
+type geoJsonFeature struct {
+	Type       string                 `json:"type"`
+	Properties map[string]interface{} `json:"properties"`
+	Geometry   struct {
+		Type        string      `json:"type"`
+		Coordinates interface{} `json:"coordinates"`
+	} `json:"geometry"`
+}
+
+func (g *geoJsonWriter) contentType() string { return "application/geo+json" }
+func (g *geoJsonWriter) extension() string   { return "geojson" }
+
+func (g *geoJsonWriter) begin() error {
+	_, err := io.WriteString(g.w, `{"type":"FeatureCollection","features":[`)
+	return err
+}
+
+func (g *geoJsonWriter) position(l objectLocation) []float64 {
+	x, y, z := g.t(l)
+	return []float64{x, y, z}
+}
+
+func (g *geoJsonWriter) feature(f geoJsonFeature) error {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	if g.count > 0 {
+		if _, err := io.WriteString(g.w, ","); err != nil {
+			return err
+		}
+	}
+	g.count++
+	_, err = g.w.Write(b)
+	return err
+}
+
+func (g *geoJsonWriter) object(uuid string, locations []objectLocation) error {
+	if len(locations) == 0 {
+		return nil
+	}
+
+	if g.points || len(locations) == 1 {
+		for _, l := range locations {
+			f := geoJsonFeature{Type: "Feature", Properties: map[string]interface{}{
+				"uuid": uuid,
+				"time": formatExportTime(l.Time),
+			}}
+			f.Geometry.Type = "Point"
+			f.Geometry.Coordinates = g.position(l)
+			if err := g.feature(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	coordinates := make([][]float64, len(locations))
+	times := make([]string, len(locations))
+	for i, l := range locations {
+		coordinates[i] = g.position(l)
+		times[i] = formatExportTime(l.Time)
+	}
+	f := geoJsonFeature{Type: "Feature", Properties: map[string]interface{}{
+		"uuid":  uuid,
+		"start": times[0],
+		"end":   times[len(times)-1],
+		"times": times,
+	}}
+	f.Geometry.Type = "LineString"
+	f.Geometry.Coordinates = coordinates
+	return g.feature(f)
+}
+
+func (g *geoJsonWriter) end() error {
+	_, err := io.WriteString(g.w, "]}")
+	return err
+}
+
+type csvWriter struct {
+	w *csv.Writer
+	t coordinateTransform
+}
+
+func (c *csvWriter) contentType() string { return "text/csv" }
+func (c *csvWriter) extension() string   { return "csv" }
+
+func (c *csvWriter) begin() error {
+	return c.w.Write([]string{"object", "time", "timestamp", "x", "y", "z"})
+}
+
+func (c *csvWriter) object(uuid string, locations []objectLocation) error {
+	for _, l := range locations {
+		x, y, z := c.t(l)
+		err := c.w.Write([]string{
+			uuid,
+			formatExportTime(l.Time),
+			strconv.FormatInt(l.Time, 10),
+			strconv.FormatFloat(x, 'f', -1, 64),
+			strconv.FormatFloat(y, 'f', -1, 64),
+			strconv.FormatFloat(z, 'f', -1, 64),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvWriter) end() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// gpxWriter writes one track per object, taking the transformed x as longitude,
+// y as latitude and z as elevation
+type gpxWriter struct {
+	w io.Writer
+	t coordinateTransform
+}
+
+type gpxTrack struct {
+	XMLName xml.Name   `xml:"trk"`
+	Name    string     `xml:"name"`
+	Points  []gpxPoint `xml:"trkseg>trkpt"`
+}
+
+type gpxPoint struct {
+	Lat       float64 `xml:"lat,attr"`
+	Lon       float64 `xml:"lon,attr"`
+	Elevation float64 `xml:"ele"`
+	Time      string  `xml:"time"`
+}
+
+func (g *gpxWriter) contentType() string { return "application/gpx+xml" }
+func (g *gpxWriter) extension() string   { return "gpx" }
+
+func (g *gpxWriter) begin() error {
+	_, err := io.WriteString(g.w, xml.Header+
+		`<gpx version="1.1" creator="acubed edge" xmlns="http://www.topografix.com/GPX/1/1">`)
+	return err
+}
+
+func (g *gpxWriter) object(uuid string, locations []objectLocation) error {
+	track := gpxTrack{Name: uuid, Points: make([]gpxPoint, len(locations))}
+	for i, l := range locations {
+		x, y, z := g.t(l)
+		track.Points[i] = gpxPoint{Lat: y, Lon: x, Elevation: z, Time: formatExportTime(l.Time)}
+	}
+
+	b, err := xml.Marshal(track)
+	if err != nil {
+		return err
+	}
+	_, err = g.w.Write(b)
+	return err
+}
+
+func (g *gpxWriter) end() error {
+	_, err := io.WriteString(g.w, "</gpx>")
+	return err
+}
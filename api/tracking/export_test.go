@@ -0,0 +1,56 @@
+package tracking
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestNewTrajectoryWriter(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		geo     bool
+		want    string
+		wantErr bool
+	}{
+		{"default without geo reference", "", false, "csv", false},
+		{"default with geo reference", "", true, "geojson", false},
+		{"csv", "csv", false, "csv", false},
+		{"geojson without geo reference", "geojson", false, "", true},
+		{"gpx without geo reference", "gpx", false, "", true},
+		{"gpx with geo reference", "gpx", true, "gpx", false},
+		{"unknown", "kml", true, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tw, err := newTrajectoryWriter(&bytes.Buffer{}, tt.format, "", identityTransform, tt.geo)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newTrajectoryWriter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && tw.extension() != tt.want {
+				t.Errorf("newTrajectoryWriter() = %s, want %s", tw.extension(), tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTransform(t *testing.T) {
+	transform, geo, err := parseTransform("geo:51,4,10,90")
+	if err != nil || !geo {
+		t.Fatalf("parseTransform() geo = %v, error = %v", geo, err)
+	}
+	// with a heading of 90 degrees the y axis points east
+	lon, lat, alt := transform(objectLocation{Y: 1000, Z: 2})
+	if math.Abs(lat-51) > 1e-6 || lon <= 4 || lon > 4.1 || alt != 12 {
+		t.Errorf("transform() = %v, %v, %v", lon, lat, alt)
+	}
+
+	if _, geo, err := parseTransform("affine:1,0,0,0,0,1,0,0,0,0,1,0"); err != nil || geo {
+		t.Errorf("parseTransform(affine) geo = %v, error = %v", geo, err)
+	}
+	if _, _, err := parseTransform("geo:1,2"); err == nil {
+		t.Error("parseTransform() accepted a geo transform without heading")
+	}
+}
@@ -0,0 +1,282 @@
+package tracking
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/acubed-tm/edge/api/webhooks"
+	"github.com/acubed-tm/edge/helpers"
+)
+
+// The geofence compares object positions against the zones as the edge sees
+// them and emits an event when an object enters a zone, leaves it, or has been
+// inside for the dwell time of the zone.
+
+const (
+	zoneEnter = "enter"
+	zoneExit  = "exit"
+	zoneDwell = "dwell"
+)
+
+// amount of events kept in memory for GET /zones/events
+const maxZoneEvents = 10000
+
+type zoneEvent struct {
+	Type         string         `json:"type"`
+	ZoneUuid     string         `json:"zone"`
+	Organisation string         `json:"organisation"` // of the zone
+	ObjectUuid   string         `json:"object"`
+	Time         int64          `json:"time"`
+	Location     objectLocation `json:"location"`
+}
+
+type zoneState struct {
+	Since int64
+	Dwelt bool
+}
+
+type geofence struct {
+	mu sync.Mutex
+	// object uuid -> zone uuid -> state, only for zones the object is in
+	inside map[string]map[string]*zoneState
+	// object uuid -> time of the last location that was evaluated
+	lastSeen    map[string]int64
+	events      []zoneEvent
+	subscribers map[chan zoneEvent]struct{}
+}
+
+var fences = &geofence{
+	inside:      map[string]map[string]*zoneState{},
+	lastSeen:    map[string]int64{},
+	subscribers: map[chan zoneEvent]struct{}{},
+}
+
+// observe evaluates a new location of an object against all zones. Locations
+// that are not newer than the last evaluated one are ignored.
+func (g *geofence) observe(objectUuid string, l objectLocation) {
+	g.observeAll(objectUuid, []objectLocation{l})
+}
+
+// observeAll evaluates a location history, oldest first. The first time an
+// object is seen its history only sets up which zones it is in, without
+// emitting events: those happened before the edge was watching.
+func (g *geofence) observeAll(objectUuid string, locations []objectLocation) {
+	all := zones.all()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	_, seen := g.lastSeen[objectUuid]
+	for _, l := range locations {
+		g.evaluate(all, objectUuid, l, seen)
+	}
+}
+
+// evaluate must be called with the lock held
+func (g *geofence) evaluate(all []zone, objectUuid string, l objectLocation, emit bool) {
+	if last, ok := g.lastSeen[objectUuid]; ok && l.Time <= last {
+		return
+	}
+	g.lastSeen[objectUuid] = l.Time
+
+	states := g.inside[objectUuid]
+	if states == nil {
+		states = map[string]*zoneState{}
+		g.inside[objectUuid] = states
+	}
+
+	for _, z := range all {
+		state, wasInside := states[z.Uuid]
+		isInside := z.contains(l)
+
+		var event string
+		switch {
+		case isInside && !wasInside:
+			states[z.Uuid] = &zoneState{Since: l.Time}
+			event = zoneEnter
+		case !isInside && wasInside:
+			delete(states, z.Uuid)
+			event = zoneExit
+		case isInside && z.Dwell > 0 && !state.Dwelt && l.Time-state.Since >= z.Dwell:
+			state.Dwelt = true
+			event = zoneDwell
+		}
+		if event != "" && emit {
+			g.emit(zoneEvent{Type: event, ZoneUuid: z.Uuid, Organisation: z.Organisation, ObjectUuid: objectUuid, Time: l.Time, Location: l})
+		}
+	}
+}
+
+// forgetZone drops all state of a zone that was changed or removed
+func (g *geofence) forgetZone(zoneUuid string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, states := range g.inside {
+		delete(states, zoneUuid)
+	}
+}
+
+// emit must be called with the lock held
+func (g *geofence) emit(e zoneEvent) {
+	g.events = append(g.events, e)
+	if len(g.events) > maxZoneEvents {
+		g.events = g.events[len(g.events)-maxZoneEvents:]
+	}
+
+	webhooks.Publish(e.Organisation, "zone."+e.Type, e)
+
+	for ch := range g.subscribers {
+		select {
+		case ch <- e:
+		default:
+			log.Printf("Dropping zone event for slow subscriber")
+		}
+	}
+}
+
+// subscribe returns a channel that receives all new events until unsubscribed
+func (g *geofence) subscribe() chan zoneEvent {
+	ch := make(chan zoneEvent, 64)
+	g.mu.Lock()
+	g.subscribers[ch] = struct{}{}
+	g.mu.Unlock()
+	return ch
+}
+
+func (g *geofence) unsubscribe(ch chan zoneEvent) {
+	g.mu.Lock()
+	delete(g.subscribers, ch)
+	g.mu.Unlock()
+}
+
+// query returns the most recent events matching the filter, oldest first
+func (g *geofence) query(filter zoneEventFilter, limit int) []zoneEvent {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ret := []zoneEvent{}
+	for i := len(g.events) - 1; i >= 0 && len(ret) < limit; i-- {
+		if filter.matches(g.events[i]) {
+			ret = append(ret, g.events[i])
+		}
+	}
+	for i, j := 0, len(ret)-1; i < j; i, j = i+1, j-1 {
+		ret[i], ret[j] = ret[j], ret[i]
+	}
+	return ret
+}
+
+type zoneEventFilter struct {
+	Zone   string
+	Object string
+	Type   string
+	From   int64
+	To     int64
+}
+
+func (f zoneEventFilter) matches(e zoneEvent) bool {
+	return (f.Zone == "" || f.Zone == e.ZoneUuid) &&
+		(f.Object == "" || f.Object == e.ObjectUuid) &&
+		(f.Type == "" || f.Type == e.Type) &&
+		(f.From == 0 || e.Time >= f.From) &&
+		(f.To == 0 || e.Time <= f.To)
+}
+
+func parseZoneEventFilter(r *http.Request) (zoneEventFilter, error) {
+	values := r.URL.Query()
+	f := zoneEventFilter{
+		Zone:   values.Get("zone"),
+		Object: values.Get("object"),
+		Type:   values.Get("type"),
+	}
+	var err error
+
+	if f.Type != "" && f.Type != zoneEnter && f.Type != zoneExit && f.Type != zoneDwell {
+		return f, errors.New("type must be one of enter, exit or dwell")
+	}
+	if v := values.Get("from"); v != "" {
+		if f.From, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return f, errors.New("from must be a ms epoch")
+		}
+	}
+	if v := values.Get("to"); v != "" {
+		if f.To, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return f, errors.New("to must be a ms epoch")
+		}
+	}
+	return f, nil
+}
+
+func getZoneEvents(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseZoneEventFilter(r)
+	if err != nil {
+		helpers.WriteErrorJson(w, r, err)
+		return
+	}
+
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxZoneEvents {
+			helpers.WriteErrorJson(w, r, fmt.Errorf("limit must be between 1 and %d", maxZoneEvents))
+			return
+		}
+	}
+
+	helpers.WriteSuccessJson(w, r, fences.query(filter, limit))
+}
+
+// streamZoneEvents sends new events as server-sent events until the client goes away
+func streamZoneEvents(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseZoneEventFilter(r)
+	if err != nil {
+		helpers.WriteErrorJson(w, r, err)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		helpers.WriteErrorJson(w, r, errors.New("streaming is not supported"))
+		return
+	}
+
+	events := fences.subscribe()
+	defer fences.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case e := <-events:
+			if !filter.matches(e) {
+				continue
+			}
+			b, err := json.Marshal(e)
+			if err != nil {
+				log.Printf("Could not marshal zone event: %v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, b); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
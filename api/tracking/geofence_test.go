@@ -0,0 +1,49 @@
+package tracking
+
+import (
+	"testing"
+)
+
+func TestGeofence(t *testing.T) {
+	defer func(previous *zoneStore) { zones = previous }(zones)
+	zones = &zoneStore{zones: map[string]zone{
+		"z": {Uuid: "z", Name: "z", Shape: "box", Box: &zoneBox{MinX: 0, MinY: 0, MaxX: 10, MaxY: 10}, Dwell: 100},
+	}}
+	g := &geofence{
+		inside:      map[string]map[string]*zoneState{},
+		lastSeen:    map[string]int64{},
+		subscribers: map[chan zoneEvent]struct{}{},
+	}
+	at := func(x float64, time int64) objectLocation { return objectLocation{X: x, Y: 5, Time: time} }
+
+	// history from before the edge was watching: entered, left and entered again
+	g.observeAll("o", []objectLocation{at(5, 1), at(20, 2), at(5, 10)})
+	if len(g.events) != 0 {
+		t.Fatalf("first observation emitted %v", g.events)
+	}
+
+	tests := []struct {
+		name     string
+		location objectLocation
+		want     string
+	}{
+		{"older location", at(20, 5), ""},
+		{"still inside", at(6, 50), ""},
+		{"dwelt since the seeded enter", at(6, 110), zoneDwell},
+		{"dwell only once", at(6, 300), ""},
+		{"exit", at(20, 400), zoneExit},
+		{"enter", at(5, 500), zoneEnter},
+	}
+
+	for _, tt := range tests {
+		before := len(g.events)
+		g.observe("o", tt.location)
+		var got string
+		if len(g.events) > before {
+			got = g.events[len(g.events)-1].Type
+		}
+		if got != tt.want || len(g.events) > before+1 {
+			t.Errorf("%s: got event %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -2,46 +2,54 @@ package tracking
 
 import (
 	"context"
+	"fmt"
 	"github.com/acubed-tm/edge/helpers"
 	proto "github.com/acubed-tm/edge/protofiles"
 	"github.com/go-chi/chi"
 	"google.golang.org/grpc"
 	"net/http"
+	"sort"
 )
 
 const service = "tracking-service.acubed:50551"
 
-func addCapture(w http.ResponseWriter, r *http.Request) {
-	// this struct may change
-	var req []struct {
-		CaptureX   float32 `json:"x"`
-		CaptureY   float32 `json:"y"`
-		Time       int64   `json:"time"`
-		ObjectUuid string  `json:"code"`
-		CameraUuid string  `json:"camera"`
-	}
+var (
+	objectCache   = helpers.NewCache("objects")
+	locationCache = helpers.NewCache("locations")
+)
+
+// invalidateObject drops everything cached about the object
+func invalidateObject(uuid string) {
+	objectCache.InvalidateAll()
+	locationCache.Invalidate(uuid)
+}
 
-	err := helpers.GetJsonFromRequestBody(r, &req)
+func addCapture(w http.ResponseWriter, r *http.Request) {
+	captures, err := decodeCaptures(r)
 	if err != nil {
 		helpers.WriteErrorJson(w, r, err)
 		return
 	}
 
-	for _, e := range req {
-		// ensure ms epochs
-		if e.Time < 1500000000000 {
-			e.Time *= 1000
-		}
+	if err := cameras.checkCaptures(captures, getCurrentCamera(r)); err != nil {
+		helpers.WriteErrorJsonStatus(w, r, http.StatusForbidden, err)
+		return
+	}
+	cameras.recordCaptures(captures)
+
+	key := helpers.GetIdempotencyKey(r)
+	for i, capture := range captures {
 		_, err = helpers.RunGrpc(service, func(ctx context.Context, conn *grpc.ClientConn) (interface{}, error) {
 			c := proto.NewTrackingServiceClient(conn)
-			return c.AddCapture(ctx, &proto.AddCaptureRequest{
-				CaptureX:   e.CaptureX,
-				CaptureY:   e.CaptureY,
-				Time:       e.Time,
-				ObjectUuid: e.ObjectUuid,
-				CameraUuid: e.CameraUuid,
-			})
+			if key != "" {
+				// every capture of the batch is a call of its own
+				ctx = helpers.WithIdempotencyKey(ctx, fmt.Sprintf("%s/%d", key, i))
+			}
+			return c.AddCapture(ctx, capture)
 		})
+		if err != nil {
+			break
+		}
 	}
 
 	if err != nil {
@@ -49,9 +57,29 @@ func addCapture(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	publishCaptures(captures)
+	for _, capture := range captures {
+		positions.schedule(capture.ObjectUuid)
+	}
+
 	helpers.WriteSuccess(w, r)
 }
 
+// updatePositions has the tracking service recompute the positions of an
+// object from its captures, or of all objects when uuid is empty
+func updatePositions(uuid string) error {
+	_, err := helpers.RunGrpc(service, func(ctx context.Context, conn *grpc.ClientConn) (interface{}, error) {
+		c := proto.NewTrackingServiceClient(conn)
+		return c.UpdatePositions(ctx, &proto.UpdatePositionsRequest{Uuid: uuid})
+	})
+	return err
+}
+
+// isFreshRequested is true when the request asks to recompute positions before reading them
+func isFreshRequested(r *http.Request) bool {
+	return r.URL.Query().Get("fresh") == "true"
+}
+
 type objectLocation struct {
 	X    float64 `json:"x"`
 	Y    float64 `json:"y"`
@@ -59,23 +87,51 @@ type objectLocation struct {
 	Time int64   `json:"time"`
 }
 
+type objectInfo struct {
+	Uuid     string          `json:"uuid"`
+	Name     string          `json:"name"`
+	Note     string          `json:"note"`
+	Location *objectLocation `json:"lastLocation,omitempty"` // nil until the object is first seen
+	Distance *float64        `json:"distance,omitempty"`     // to the point of a spatial query
+}
+
 func getAllObjects(w http.ResponseWriter, r *http.Request) {
-	type objectInfo struct {
-		Uuid     string         `json:"uuid"`
-		Name     string         `json:"name"`
-		Note     string         `json:"note"`
-		Location objectLocation `json:"lastLocation"`
+	query, err := parseObjectQuery(r.URL.Query())
+	if err != nil {
+		helpers.WriteErrorJson(w, r, err)
+		return
 	}
 
-	_, err := helpers.RunGrpc(service, func(ctx context.Context, conn *grpc.ClientConn) (interface{}, error) {
-		c := proto.NewTrackingServiceClient(conn)
-		return c.UpdatePositions(ctx, &proto.UpdatePositionsRequest{Uuid:""})
-	})
+	objects, cacheInfo, err := getObjectInfos(isFreshRequested(r))
 	if err != nil {
 		helpers.WriteErrorJson(w, r, err)
 		return
 	}
 
+	page, next := query.apply(objects)
+	helpers.WriteCacheHeaders(w, cacheInfo)
+	helpers.WriteSuccessJsonPage(w, r, page, next)
+}
+
+// getObjectInfos returns all objects, recomputing their positions first when fresh is set
+func getObjectInfos(fresh bool) ([]objectInfo, helpers.CacheInfo, error) {
+	if fresh {
+		if err := updatePositions(""); err != nil {
+			return nil, helpers.CacheInfo{}, err
+		}
+		objectCache.InvalidateAll()
+	}
+
+	objects, cacheInfo, err := objectCache.Get("", func() (interface{}, error) {
+		return fetchObjectInfos()
+	})
+	if err != nil {
+		return nil, cacheInfo, err
+	}
+	return objects.([]objectInfo), cacheInfo, nil
+}
+
+func fetchObjectInfos() ([]objectInfo, error) {
 	objects, err := helpers.RunGrpc(service, func(ctx context.Context, conn *grpc.ClientConn) (interface{}, error) {
 		c := proto.NewTrackingServiceClient(conn)
 		resp, err := c.GetAllObjects(ctx, &proto.GetAllObjectsRequest{})
@@ -88,38 +144,86 @@ func getAllObjects(w http.ResponseWriter, r *http.Request) {
 				Uuid: e.Uuid,
 				Name: e.Name,
 				Note: e.Note,
-				Location: objectLocation{
+			}
+			if e.LastLocation != nil {
+				ret[i].Location = &objectLocation{
 					X:    e.LastLocation.X,
 					Y:    e.LastLocation.Y,
 					Z:    e.LastLocation.Z,
 					Time: e.LastLocation.Time,
-				},
+				}
 			}
 		}
 		return ret, nil
 	})
-
 	if err != nil {
-		helpers.WriteErrorJson(w, r, err)
-		return
+		return nil, err
 	}
 
-	helpers.WriteSuccessJson(w, r, objects)
+	for _, o := range objects.([]objectInfo) {
+		if o.Location != nil {
+			fences.observe(o.Uuid, *o.Location)
+		}
+	}
+
+	return objects.([]objectInfo), nil
 }
 
 func getObject(w http.ResponseWriter, r *http.Request) {
 	uuid := chi.URLParam(r, "uuid")
 
-	_, err := helpers.RunGrpc(service, func(ctx context.Context, conn *grpc.ClientConn) (interface{}, error) {
-		c := proto.NewTrackingServiceClient(conn)
-		return c.UpdatePositions(ctx, &proto.UpdatePositionsRequest{Uuid:uuid})
-	})
+	query, err := parseHistoryQuery(r.URL.Query())
 	if err != nil {
 		helpers.WriteErrorJson(w, r, err)
 		return
 	}
 
-	objects, err := helpers.RunGrpc(service, func(ctx context.Context, conn *grpc.ClientConn) (interface{}, error) {
+	locations, cacheInfo, err := getObjectLocations(uuid, isFreshRequested(r))
+	if err != nil {
+		helpers.WriteErrorJson(w, r, err)
+		return
+	}
+
+	page, next := query.apply(locations)
+	helpers.WriteCacheHeaders(w, cacheInfo)
+	if next == nil {
+		helpers.WriteSuccessJsonPage(w, r, page, "")
+		return
+	}
+	helpers.WriteSuccessJsonPage(w, r, page, next.String())
+}
+
+// getObjectLocations returns the full location history of the object,
+// recomputing its positions first when fresh is set
+func getObjectLocations(uuid string, fresh bool) ([]objectLocation, helpers.CacheInfo, error) {
+	if fresh {
+		if err := updatePositions(uuid); err != nil {
+			return nil, helpers.CacheInfo{}, err
+		}
+		locationCache.Invalidate(uuid)
+	}
+
+	locations, cacheInfo, err := locationCache.Get(uuid, func() (interface{}, error) {
+		return fetchObjectLocations(uuid)
+	})
+	if err != nil {
+		return nil, cacheInfo, err
+	}
+	return locations.([]objectLocation), cacheInfo, nil
+}
+
+func fetchObjectLocations(uuid string) ([]objectLocation, error) {
+	locations, err := readObjectLocations(uuid)
+	if err != nil {
+		return nil, err
+	}
+	fences.observeAll(uuid, locations)
+	return locations, nil
+}
+
+// readObjectLocations gets the location history of the object, oldest first
+func readObjectLocations(uuid string) ([]objectLocation, error) {
+	locations, err := helpers.RunGrpc(service, func(ctx context.Context, conn *grpc.ClientConn) (interface{}, error) {
 		c := proto.NewTrackingServiceClient(conn)
 		resp, err := c.GetObject(ctx, &proto.GetObjectRequest{Uuid: uuid})
 		if err != nil {
@@ -136,11 +240,11 @@ func getObject(w http.ResponseWriter, r *http.Request) {
 		}
 		return ret, nil
 	})
-
 	if err != nil {
-		helpers.WriteErrorJson(w, r, err)
-		return
+		return nil, err
 	}
 
-	helpers.WriteSuccessJson(w, r, objects)
+	ret := locations.([]objectLocation)
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Time < ret[j].Time })
+	return ret, nil
 }
@@ -0,0 +1,245 @@
+package tracking
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// historyQuery holds the query parameters accepted by GET /object/{uuid}:
+//
+//	from, to       ms epochs bounding the locations (inclusive)
+//	limit, cursor  page size and the cursor returned with the previous page
+//	downsample     "bucket" (with bucket=<ms>) or "simplify" (with tolerance=<distance>)
+//
+// The tracking service always returns the full history of an object, so all
+// of this is applied at the edge.
+type historyQuery struct {
+	From       int64
+	To         int64
+	Limit      int
+	Cursor     *historyCursor
+	Downsample string
+	Bucket     int64
+	Tolerance  float64
+}
+
+const maxHistoryLimit = 10000
+
+// historyCursor points right after the last location of the previous page. Skip
+// is the amount of locations with that exact time that were already returned.
+type historyCursor struct {
+	Time int64
+	Skip int
+}
+
+func (c historyCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d,%d", c.Time, c.Skip)))
+}
+
+func parseHistoryCursor(s string) (*historyCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	parts := strings.Split(string(b), ",")
+	if len(parts) != 2 {
+		return nil, errors.New("invalid cursor")
+	}
+	t, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	skip, err := strconv.Atoi(parts[1])
+	if err != nil || skip < 1 {
+		return nil, errors.New("invalid cursor")
+	}
+	return &historyCursor{Time: t, Skip: skip}, nil
+}
+
+func parseHistoryQuery(values url.Values) (historyQuery, error) {
+	q := historyQuery{From: math.MinInt64, To: math.MaxInt64}
+	var err error
+
+	if v := values.Get("from"); v != "" {
+		if q.From, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return q, errors.New("from must be a ms epoch")
+		}
+	}
+	if v := values.Get("to"); v != "" {
+		if q.To, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return q, errors.New("to must be a ms epoch")
+		}
+	}
+	if q.From > q.To {
+		return q, errors.New("from must not be after to")
+	}
+
+	if v := values.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 1 || q.Limit > maxHistoryLimit {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxHistoryLimit)
+		}
+	}
+	if v := values.Get("cursor"); v != "" {
+		if q.Cursor, err = parseHistoryCursor(v); err != nil {
+			return q, err
+		}
+	}
+
+	q.Downsample = values.Get("downsample")
+	switch q.Downsample {
+	case "":
+	case "bucket":
+		if q.Bucket, err = strconv.ParseInt(values.Get("bucket"), 10, 64); err != nil || q.Bucket < 1 {
+			return q, errors.New("bucket must be a positive amount of ms")
+		}
+	case "simplify":
+		if q.Tolerance, err = strconv.ParseFloat(values.Get("tolerance"), 64); err != nil || q.Tolerance < 0 {
+			return q, errors.New("tolerance must be a non-negative distance")
+		}
+	default:
+		return q, errors.New("downsample must be either bucket or simplify")
+	}
+
+	return q, nil
+}
+
+// apply filters, downsamples and pages the locations, returning the page and
+// the cursor for the next one, or nil when this is the last page
+func (q historyQuery) apply(locations []objectLocation) ([]objectLocation, *historyCursor) {
+	ret := make([]objectLocation, 0, len(locations))
+	for _, l := range locations {
+		if l.Time >= q.From && l.Time <= q.To {
+			ret = append(ret, l)
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Time < ret[j].Time })
+
+	switch q.Downsample {
+	case "bucket":
+		ret = downsampleBuckets(ret, q.Bucket)
+	case "simplify":
+		ret = simplifyPath(ret, q.Tolerance)
+	}
+
+	if q.Cursor != nil {
+		start := sort.Search(len(ret), func(i int) bool { return ret[i].Time >= q.Cursor.Time })
+		start += q.Cursor.Skip
+		if start > len(ret) {
+			start = len(ret)
+		}
+		ret = ret[start:]
+	}
+
+	if q.Limit == 0 || len(ret) <= q.Limit {
+		return ret, nil
+	}
+
+	ret = ret[:q.Limit]
+	last := ret[len(ret)-1].Time
+	next := historyCursor{Time: last}
+	for i := len(ret) - 1; i >= 0 && ret[i].Time == last; i-- {
+		next.Skip++
+	}
+	if q.Cursor != nil && q.Cursor.Time == last {
+		// the whole page had the same time as the previous cursor
+		next.Skip += q.Cursor.Skip
+	}
+	return ret, &next
+}
+
+// downsampleBuckets averages all locations that fall in the same fixed time
+// bucket. Locations must be sorted by time.
+func downsampleBuckets(locations []objectLocation, bucket int64) []objectLocation {
+	var ret []objectLocation
+	for start := 0; start < len(locations); {
+		key := floorDiv(locations[start].Time, bucket)
+		end := start
+		var sum objectLocation
+		var sumTime float64
+		for ; end < len(locations) && floorDiv(locations[end].Time, bucket) == key; end++ {
+			sum.X += locations[end].X
+			sum.Y += locations[end].Y
+			sum.Z += locations[end].Z
+			sumTime += float64(locations[end].Time)
+		}
+
+		n := float64(end - start)
+		ret = append(ret, objectLocation{
+			X:    sum.X / n,
+			Y:    sum.Y / n,
+			Z:    sum.Z / n,
+			Time: int64(sumTime / n),
+		})
+		start = end
+	}
+	return ret
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+	return q
+}
+
+// simplifyPath runs Douglas-Peucker on the path, dropping every location that
+// is closer than tolerance to the simplified path. Locations must be sorted by
+// time.
+func simplifyPath(locations []objectLocation, tolerance float64) []objectLocation {
+	if len(locations) < 3 {
+		return locations
+	}
+
+	keep := make([]bool, len(locations))
+	keep[0], keep[len(locations)-1] = true, true
+
+	type span struct{ first, last int }
+	stack := []span{{0, len(locations) - 1}}
+	for len(stack) > 0 {
+		s := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		index, maxDistance := -1, tolerance
+		for i := s.first + 1; i < s.last; i++ {
+			d := segmentDistance(locations[i], locations[s.first], locations[s.last])
+			if d > maxDistance {
+				index, maxDistance = i, d
+			}
+		}
+
+		if index != -1 {
+			keep[index] = true
+			stack = append(stack, span{s.first, index}, span{index, s.last})
+		}
+	}
+
+	var ret []objectLocation
+	for i, l := range locations {
+		if keep[i] {
+			ret = append(ret, l)
+		}
+	}
+	return ret
+}
+
+// segmentDistance is the distance between p and the segment from a to b
+func segmentDistance(p, a, b objectLocation) float64 {
+	dx, dy, dz := b.X-a.X, b.Y-a.Y, b.Z-a.Z
+	length := dx*dx + dy*dy + dz*dz
+
+	t := 0.0
+	if length > 0 {
+		t = ((p.X-a.X)*dx + (p.Y-a.Y)*dy + (p.Z-a.Z)*dz) / length
+		t = math.Max(0, math.Min(1, t))
+	}
+
+	x, y, z := a.X+t*dx-p.X, a.Y+t*dy-p.Y, a.Z+t*dz-p.Z
+	return math.Sqrt(x*x + y*y + z*z)
+}
@@ -0,0 +1,146 @@
+package tracking
+
+import (
+	"math"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseHistoryQuery(t *testing.T) {
+	tests := []struct {
+		query   string
+		wantErr bool
+	}{
+		{"", false},
+		{"from=1&to=2", false},
+		{"from=2&to=1", true},
+		{"from=yesterday", true},
+		{"limit=10", false},
+		{"limit=0", true},
+		{"limit=10001", true},
+		{"cursor=" + historyCursor{Time: 5, Skip: 1}.String(), false},
+		{"cursor=" + historyCursor{Time: 5, Skip: 0}.String(), true},
+		{"cursor=nope", true},
+		{"downsample=bucket&bucket=1000", false},
+		{"downsample=bucket", true},
+		{"downsample=simplify&tolerance=0.5", false},
+		{"downsample=simplify&tolerance=-1", true},
+		{"downsample=median", true},
+	}
+
+	for _, tt := range tests {
+		values, _ := url.ParseQuery(tt.query)
+		if _, err := parseHistoryQuery(values); (err != nil) != tt.wantErr {
+			t.Errorf("parseHistoryQuery(%q) error = %v, wantErr %v", tt.query, err, tt.wantErr)
+		}
+	}
+}
+
+func times(locations []objectLocation) []int64 {
+	ret := []int64{}
+	for _, l := range locations {
+		ret = append(ret, l.Time)
+	}
+	return ret
+}
+
+func TestHistoryQueryPages(t *testing.T) {
+	var locations []objectLocation
+	// several locations share a time, also across page boundaries
+	for _, time := range []int64{9, 1, 2, 2, 2, 3, 4, 4, 5, 6, 7, 8} {
+		locations = append(locations, objectLocation{X: float64(len(locations)), Time: time})
+	}
+
+	tests := []struct {
+		name  string
+		query historyQuery
+		pages [][]int64
+	}{
+		{"everything", historyQuery{From: math.MinInt64, To: math.MaxInt64}, [][]int64{{1, 2, 2, 2, 3, 4, 4, 5, 6, 7, 8, 9}}},
+		{"time range", historyQuery{From: 2, To: 4}, [][]int64{{2, 2, 2, 3, 4, 4}}},
+		{"pages", historyQuery{From: math.MinInt64, To: math.MaxInt64, Limit: 3}, [][]int64{
+			{1, 2, 2}, {2, 3, 4}, {4, 5, 6}, {7, 8, 9},
+		}},
+		{"page of equal times", historyQuery{From: 2, To: 2, Limit: 1}, [][]int64{{2}, {2}, {2}}},
+		{"pages in a range", historyQuery{From: 4, To: 7, Limit: 2}, [][]int64{{4, 4}, {5, 6}, {7}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got [][]int64
+			var xs []float64
+			q := tt.query
+			for {
+				page, next := q.apply(locations)
+				got = append(got, times(page))
+				for _, l := range page {
+					xs = append(xs, l.X)
+				}
+				if next == nil {
+					break
+				}
+				// as a client would send it back
+				if q.Cursor, _ = parseHistoryCursor(next.String()); q.Cursor == nil || len(got) > 20 {
+					t.Fatalf("bad cursor %v", next)
+				}
+			}
+
+			if !reflect.DeepEqual(got, tt.pages) {
+				t.Errorf("pages = %v, want %v", got, tt.pages)
+			}
+			seen := map[float64]bool{}
+			for _, x := range xs {
+				if seen[x] {
+					t.Errorf("location %v is on more than one page", x)
+				}
+				seen[x] = true
+			}
+		})
+	}
+}
+
+func TestDownsampleBuckets(t *testing.T) {
+	locations := []objectLocation{
+		{X: 0, Time: -1500}, {X: 2, Time: -1001},
+		{X: 4, Time: 0}, {X: 6, Time: 999},
+		{X: 8, Time: 2500},
+	}
+	got := downsampleBuckets(locations, 1000)
+	want := []objectLocation{{X: 1, Time: -1250}, {X: 5, Time: 499}, {X: 8, Time: 2500}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("downsampleBuckets() = %v, want %v", got, want)
+	}
+}
+
+func TestSimplifyPath(t *testing.T) {
+	path := func(points ...[2]float64) []objectLocation {
+		ret := make([]objectLocation, len(points))
+		for i, p := range points {
+			ret[i] = objectLocation{X: p[0], Y: p[1], Time: int64(i)}
+		}
+		return ret
+	}
+
+	tests := []struct {
+		name      string
+		path      []objectLocation
+		tolerance float64
+		want      []int64
+	}{
+		{"too short", path([2]float64{0, 0}, [2]float64{1, 1}), 1, []int64{0, 1}},
+		{"straight line", path([2]float64{0, 0}, [2]float64{1, 0}, [2]float64{2, 0}, [2]float64{3, 0}), 0, []int64{0, 3}},
+		{"small wiggle", path([2]float64{0, 0}, [2]float64{1, 0.1}, [2]float64{2, -0.1}, [2]float64{3, 0}), 0.5, []int64{0, 3}},
+		{"corner", path([2]float64{0, 0}, [2]float64{1, 0}, [2]float64{2, 0}, [2]float64{2, 1}, [2]float64{2, 2}), 0.1, []int64{0, 2, 4}},
+		{"zero tolerance keeps wiggles", path([2]float64{0, 0}, [2]float64{1, 0.1}, [2]float64{2, -0.1}, [2]float64{3, 0}), 0, []int64{0, 1, 2, 3}},
+		{"back and forth", path([2]float64{0, 0}, [2]float64{5, 0}, [2]float64{0, 0}), 1, []int64{0, 1, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := times(simplifyPath(tt.path, tt.tolerance)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("simplifyPath() kept %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,13 +1,37 @@
 package tracking
 
 import (
+	"github.com/acubed-tm/edge/helpers"
 	"github.com/go-chi/chi"
 )
 
 func Routes() *chi.Mux {
 	router := chi.NewRouter()
-	router.Post("/capture", addCapture)
+	router.With(limitCaptureBody, requireCameraCredentials).Post("/capture", addCapture)
 	router.Get("/objects", getAllObjects)
 	router.Get("/object/{uuid}", getObject)
+	router.Get("/export", exportTrajectories)
+
+	router.Group(func(r chi.Router) {
+		r.Use(helpers.RequireAuthentication)
+		r.Get("/cameras", getCameras)
+		r.Get("/camera/{uuid}", getCamera)
+		r.Post("/cameras", registerCamera)
+		r.With(requireCameraAdmin).Put("/camera/{uuid}", updateCamera)
+		r.With(requireCameraAdmin).Post("/camera/{uuid}/decommission", decommissionCamera)
+		r.With(requireCameraAdmin).Put("/camera/{uuid}/calibration", updateCameraCalibration)
+		r.With(requireCameraAdmin).Get("/camera/{uuid}/keys", getCameraKeys)
+		r.With(requireCameraAdmin).Post("/camera/{uuid}/keys", issueCameraKey)
+		r.With(requireCameraAdmin).Delete("/camera/{uuid}/key/{id}", revokeCameraKey)
+
+		r.Post("/zones", createZone)
+		r.With(requireZoneAdmin).Put("/zone/{uuid}", updateZone)
+		r.With(requireZoneAdmin).Delete("/zone/{uuid}", deleteZone)
+	})
+
+	router.Get("/zones", getZones)
+	router.Get("/zones/events", getZoneEvents)
+	router.Get("/zones/events/stream", streamZoneEvents)
+	router.Get("/zone/{uuid}", getZone)
 	return router
 }
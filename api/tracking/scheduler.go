@@ -0,0 +1,98 @@
+package tracking
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/acubed-tm/edge/helpers"
+)
+
+// Positions are recomputed in the background after captures come in, instead
+// of on every read. Captures for the same object are coalesced: the update
+// waits POSITION_UPDATE_DELAY after the latest capture, but never longer than
+// POSITION_UPDATE_MAX_DELAY after the first one, and only one update per object
+// runs at a time. Reads serve whatever was computed last, unless they ask for
+// ?fresh=true.
+
+type positionScheduler struct {
+	mu       sync.Mutex
+	pending  map[string]*pendingUpdate
+	delay    time.Duration
+	maxDelay time.Duration
+}
+
+type pendingUpdate struct {
+	timer   *time.Timer
+	first   time.Time
+	running bool
+	again   bool // scheduled again while running
+}
+
+var positions = &positionScheduler{
+	pending:  map[string]*pendingUpdate{},
+	delay:    helpers.GetEnvDuration("POSITION_UPDATE_DELAY", time.Second),
+	maxDelay: helpers.GetEnvDuration("POSITION_UPDATE_MAX_DELAY", 5*time.Second),
+}
+
+// schedule makes sure the positions of the object are recomputed soon
+func (s *positionScheduler) schedule(uuid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.pending[uuid]
+	if !ok {
+		p = &pendingUpdate{first: time.Now()}
+		p.timer = time.AfterFunc(s.delay, func() { s.run(uuid) })
+		s.pending[uuid] = p
+		return
+	}
+
+	if p.running {
+		p.again = true
+		return
+	}
+
+	wait := s.delay
+	if remaining := s.maxDelay - time.Since(p.first); remaining < wait {
+		wait = remaining
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	p.timer.Reset(wait)
+}
+
+func (s *positionScheduler) run(uuid string) {
+	s.mu.Lock()
+	p, ok := s.pending[uuid]
+	if !ok || p.running {
+		s.mu.Unlock()
+		return
+	}
+	p.running = true
+	s.mu.Unlock()
+
+	if err := updatePositions(uuid); err != nil {
+		log.Printf("Could not update positions of %s: %v", uuid, err)
+	} else {
+		invalidateObject(uuid)
+		if len(zones.all()) > 0 {
+			// reading the locations lets the geofence see the object move
+			if _, _, err := getObjectLocations(uuid, false); err != nil {
+				log.Printf("Could not get locations of %s: %v", uuid, err)
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p.again {
+		p.again = false
+		p.running = false
+		p.first = time.Now()
+		p.timer.Reset(s.delay)
+		return
+	}
+	delete(s.pending, uuid)
+}
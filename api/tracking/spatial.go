@@ -0,0 +1,218 @@
+package tracking
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// objectQuery holds the query parameters accepted by GET /objects:
+//
+//	bbox=minX,minY,maxX,maxY  only objects last seen inside the box
+//	near=x,y[,z]              reference point for radius, nearest and sort=distance
+//	radius=<distance>         only objects within the distance of near
+//	nearest=<n>               only the n objects closest to near
+//	zone=<uuid>               only objects last seen inside the zone
+//	maxAge, minAge=<ms>       only objects last seen at most/least this long ago
+//	sort=distance|recency     closest or most recently seen first
+//	limit, cursor             page size and the cursor returned with the previous page
+//
+// The tracking service can't filter objects yet, so this is all done at the edge.
+type objectQuery struct {
+	Box     *zoneBox
+	Near    []float64
+	Radius  float64
+	Nearest int
+	Zone    *zone
+	MaxAge  int64
+	MinAge  int64
+	Sort    string
+	Limit   int
+	Offset  int
+}
+
+const maxObjectLimit = 1000
+
+func parseFloats(s string, name string, counts ...int) ([]float64, error) {
+	var ret []float64
+	for _, v := range strings.Split(s, ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a list of numbers", name)
+		}
+		ret = append(ret, f)
+	}
+	for _, c := range counts {
+		if len(ret) == c {
+			return ret, nil
+		}
+	}
+	return nil, fmt.Errorf("%s has the wrong amount of numbers", name)
+}
+
+func parseObjectQuery(values url.Values) (objectQuery, error) {
+	var q objectQuery
+	var err error
+
+	if v := values.Get("bbox"); v != "" {
+		b, err := parseFloats(v, "bbox", 4)
+		if err != nil {
+			return q, err
+		}
+		if b[0] > b[2] || b[1] > b[3] {
+			return q, errors.New("bbox must be minX,minY,maxX,maxY")
+		}
+		q.Box = &zoneBox{MinX: b[0], MinY: b[1], MaxX: b[2], MaxY: b[3]}
+	}
+	if v := values.Get("near"); v != "" {
+		if q.Near, err = parseFloats(v, "near", 2, 3); err != nil {
+			return q, err
+		}
+	}
+	if v := values.Get("radius"); v != "" {
+		if q.Radius, err = strconv.ParseFloat(v, 64); err != nil || q.Radius <= 0 {
+			return q, errors.New("radius must be a positive distance")
+		}
+	}
+	if v := values.Get("nearest"); v != "" {
+		if q.Nearest, err = strconv.Atoi(v); err != nil || q.Nearest < 1 {
+			return q, errors.New("nearest must be a positive number")
+		}
+	}
+	if q.Near == nil && (q.Radius != 0 || q.Nearest != 0) {
+		return q, errors.New("radius and nearest need near")
+	}
+	if v := values.Get("zone"); v != "" {
+		z, ok := zones.get(v)
+		if !ok {
+			return q, errZoneNotFound
+		}
+		q.Zone = &z
+	}
+	if v := values.Get("maxAge"); v != "" {
+		if q.MaxAge, err = strconv.ParseInt(v, 10, 64); err != nil || q.MaxAge < 0 {
+			return q, errors.New("maxAge must be an amount of ms")
+		}
+	}
+	if v := values.Get("minAge"); v != "" {
+		if q.MinAge, err = strconv.ParseInt(v, 10, 64); err != nil || q.MinAge < 0 {
+			return q, errors.New("minAge must be an amount of ms")
+		}
+	}
+
+	q.Sort = values.Get("sort")
+	switch q.Sort {
+	case "", "recency":
+	case "distance":
+		if q.Near == nil {
+			return q, errors.New("sorting by distance needs near")
+		}
+	default:
+		return q, errors.New("sort must be either distance or recency")
+	}
+
+	if v := values.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 1 || q.Limit > maxObjectLimit {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxObjectLimit)
+		}
+	}
+	if v := values.Get("cursor"); v != "" {
+		b, err := base64.RawURLEncoding.DecodeString(v)
+		if err == nil {
+			q.Offset, err = strconv.Atoi(string(b))
+		}
+		if err != nil || q.Offset < 0 {
+			return q, errors.New("invalid cursor")
+		}
+	}
+
+	return q, nil
+}
+
+func (q objectQuery) distance(l objectLocation) float64 {
+	dx, dy := l.X-q.Near[0], l.Y-q.Near[1]
+	if len(q.Near) == 3 {
+		dz := l.Z - q.Near[2]
+		return math.Sqrt(dx*dx + dy*dy + dz*dz)
+	}
+	return math.Sqrt(dx*dx + dy*dy)
+}
+
+func (q objectQuery) matches(o objectInfo, now int64) bool {
+	if o.Location == nil {
+		// objects that were never seen have no place to filter or sort on
+		return q.Box == nil && q.Near == nil && q.Zone == nil && q.MaxAge == 0 && q.MinAge == 0
+	}
+	l := *o.Location
+	if q.Box != nil && (l.X < q.Box.MinX || l.X > q.Box.MaxX || l.Y < q.Box.MinY || l.Y > q.Box.MaxY) {
+		return false
+	}
+	if q.Radius != 0 && q.distance(l) > q.Radius {
+		return false
+	}
+	if q.Zone != nil && !q.Zone.contains(l) {
+		return false
+	}
+	age := now - l.Time
+	if q.MaxAge != 0 && age > q.MaxAge {
+		return false
+	}
+	if q.MinAge != 0 && age < q.MinAge {
+		return false
+	}
+	return true
+}
+
+// apply filters, sorts and pages the objects, returning the page and the cursor
+// of the next one, or an empty string when this is the last page
+func (q objectQuery) apply(objects []objectInfo) ([]objectInfo, string) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	ret := make([]objectInfo, 0, len(objects))
+	for _, o := range objects {
+		if q.matches(o, now) {
+			if q.Near != nil {
+				d := q.distance(*o.Location)
+				o.Distance = &d
+			}
+			ret = append(ret, o)
+		}
+	}
+	// the tracking service returns objects in any order, so pages are cut from
+	// a fixed one; the sorts below are stable and keep it among equals
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Uuid < ret[j].Uuid })
+
+	if q.Nearest != 0 {
+		sort.SliceStable(ret, func(i, j int) bool { return *ret[i].Distance < *ret[j].Distance })
+		if len(ret) > q.Nearest {
+			ret = ret[:q.Nearest]
+		}
+	}
+
+	switch q.Sort {
+	case "distance":
+		sort.SliceStable(ret, func(i, j int) bool { return *ret[i].Distance < *ret[j].Distance })
+	case "recency":
+		// objects that were never seen come last
+		sort.SliceStable(ret, func(i, j int) bool {
+			a, b := ret[i].Location, ret[j].Location
+			return a != nil && (b == nil || a.Time > b.Time)
+		})
+	}
+
+	if q.Offset >= len(ret) {
+		return []objectInfo{}, ""
+	}
+	ret = ret[q.Offset:]
+	if q.Limit == 0 || len(ret) <= q.Limit {
+		return ret, ""
+	}
+	next := base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(q.Offset + q.Limit)))
+	return ret[:q.Limit], next
+}
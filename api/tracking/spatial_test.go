@@ -0,0 +1,113 @@
+package tracking
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseObjectQuery(t *testing.T) {
+	tests := []struct {
+		query   string
+		wantErr bool
+	}{
+		{"", false},
+		{"bbox=0,0,10,10", false},
+		{"bbox=0,0,0,0", false},
+		{"bbox=10,0,0,10", true},
+		{"bbox=0,10,10,0", true},
+		{"bbox=0,0,10", true},
+		{"near=1,2&radius=5", false},
+		{"radius=5", true},
+		{"near=1,2,3&nearest=2&sort=distance", false},
+		{"sort=distance", true},
+		{"sort=name", true},
+		{"limit=0", true},
+		{"cursor=nope!", true},
+	}
+
+	for _, tt := range tests {
+		values, _ := url.ParseQuery(tt.query)
+		if _, err := parseObjectQuery(values); (err != nil) != tt.wantErr {
+			t.Errorf("parseObjectQuery(%q) error = %v, wantErr %v", tt.query, err, tt.wantErr)
+		}
+	}
+}
+
+func TestObjectQueryPages(t *testing.T) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	var objects []objectInfo
+	for i := 9; i >= 0; i-- {
+		o := objectInfo{Uuid: fmt.Sprintf("o%d", i)}
+		if i != 4 {
+			// the same time for all, so recency doesn't decide the order
+			o.Location = &objectLocation{X: float64(i), Y: 0, Time: now}
+		}
+		objects = append(objects, o)
+	}
+	shuffled := append([]objectInfo{}, objects[5:]...)
+	shuffled = append(shuffled, objects[:5]...)
+
+	for _, sort := range []string{"", "recency", "distance"} {
+		t.Run(sort, func(t *testing.T) {
+			q := objectQuery{Sort: sort, Limit: 3}
+			if sort == "distance" {
+				q.Near = []float64{0, 0}
+			}
+
+			// pages of differently ordered upstream results fit together
+			seen := map[string]bool{}
+			cursor := ""
+			for page := 0; ; page++ {
+				values := url.Values{"limit": {"3"}}
+				if cursor != "" {
+					values.Set("cursor", cursor)
+				}
+				parsed, err := parseObjectQuery(values)
+				if err != nil {
+					t.Fatal(err)
+				}
+				q.Offset = parsed.Offset
+
+				upstream := objects
+				if page%2 == 1 {
+					upstream = shuffled
+				}
+				var got []objectInfo
+				got, cursor = q.apply(upstream)
+				for _, o := range got {
+					if seen[o.Uuid] {
+						t.Errorf("%s is on more than one page", o.Uuid)
+					}
+					seen[o.Uuid] = true
+				}
+				if cursor == "" {
+					break
+				}
+			}
+
+			want := 10
+			if sort == "distance" {
+				// never seen, so it has no distance
+				want = 9
+			}
+			if len(seen) != want {
+				t.Errorf("pages had %d objects, want %d", len(seen), want)
+			}
+		})
+	}
+}
+
+func TestObjectQueryWithoutLocation(t *testing.T) {
+	objects := []objectInfo{{Uuid: "never-seen"}, {Uuid: "seen", Location: &objectLocation{X: 1, Y: 1, Time: 1}}}
+
+	got, _ := objectQuery{Sort: "recency"}.apply(objects)
+	if len(got) != 2 || got[0].Uuid != "seen" {
+		t.Errorf("recency put %v first, want the seen object", got)
+	}
+	got, _ = objectQuery{Box: &zoneBox{MinX: 0, MinY: 0, MaxX: 2, MaxY: 2}}.apply(objects)
+	if len(got) != 1 || got[0].Uuid != "seen" {
+		t.Errorf("bbox returned %v, want only the seen object", got)
+	}
+}
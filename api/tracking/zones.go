@@ -0,0 +1,229 @@
+package tracking
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/acubed-tm/edge/helpers"
+	"github.com/go-chi/chi"
+)
+
+// Zones are areas in the same coordinate space as objectLocation. The tracking
+// service has no notion of them, so they are kept by the edge, in memory only:
+// every replica has zones of its own and they are gone after a restart.
+// TODO: persist zones once there is a service to store them in
+
+type zonePoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+type zoneBox struct {
+	MinX float64 `json:"minX"`
+	MinY float64 `json:"minY"`
+	MaxX float64 `json:"maxX"`
+	MaxY float64 `json:"maxY"`
+}
+
+type zone struct {
+	Uuid         string      `json:"uuid"`
+	Name         string      `json:"name"`
+	Organisation string      `json:"organisation"`
+	Shape        string      `json:"shape"` // box or polygon
+	Box          *zoneBox    `json:"box,omitempty"`
+	Polygon      []zonePoint `json:"polygon,omitempty"`
+	MinZ         *float64    `json:"minZ,omitempty"`
+	MaxZ         *float64    `json:"maxZ,omitempty"`
+	Dwell        int64       `json:"dwell,omitempty"` // ms inside the zone before a dwell event, 0 to disable
+}
+
+func (z zone) validate() error {
+	if z.Name == "" {
+		return errors.New("zone needs a name")
+	}
+	if z.Organisation == "" {
+		return errors.New("zone needs an organisation")
+	}
+	switch z.Shape {
+	case "box":
+		if z.Box == nil || z.Box.MinX >= z.Box.MaxX || z.Box.MinY >= z.Box.MaxY {
+			return errors.New("box zone needs a box with min smaller than max")
+		}
+	case "polygon":
+		if len(z.Polygon) < 3 {
+			return errors.New("polygon zone needs at least 3 points")
+		}
+	default:
+		return errors.New("shape must be either box or polygon")
+	}
+	if z.MinZ != nil && z.MaxZ != nil && *z.MinZ > *z.MaxZ {
+		return errors.New("minZ must not be larger than maxZ")
+	}
+	if z.Dwell < 0 {
+		return errors.New("dwell must not be negative")
+	}
+	return nil
+}
+
+func (z zone) contains(l objectLocation) bool {
+	if z.MinZ != nil && l.Z < *z.MinZ {
+		return false
+	}
+	if z.MaxZ != nil && l.Z > *z.MaxZ {
+		return false
+	}
+
+	if z.Shape == "box" {
+		return l.X >= z.Box.MinX && l.X <= z.Box.MaxX && l.Y >= z.Box.MinY && l.Y <= z.Box.MaxY
+	}
+
+	// ray casting, count the edges crossed by a ray going right from the location
+	inside := false
+	for i, j := 0, len(z.Polygon)-1; i < len(z.Polygon); j, i = i, i+1 {
+		a, b := z.Polygon[i], z.Polygon[j]
+		if (a.Y > l.Y) != (b.Y > l.Y) && l.X < (b.X-a.X)*(l.Y-a.Y)/(b.Y-a.Y)+a.X {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+type zoneStore struct {
+	mu    sync.RWMutex
+	zones map[string]zone
+}
+
+var zones = &zoneStore{zones: map[string]zone{}}
+
+func (s *zoneStore) all() []zone {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ret := make([]zone, 0, len(s.zones))
+	for _, z := range s.zones {
+		ret = append(ret, z)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+func (s *zoneStore) get(uuid string) (zone, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	z, ok := s.zones[uuid]
+	return z, ok
+}
+
+func (s *zoneStore) put(z zone) {
+	s.mu.Lock()
+	s.zones[z.Uuid] = z
+	s.mu.Unlock()
+}
+
+func (s *zoneStore) delete(uuid string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.zones[uuid]
+	delete(s.zones, uuid)
+	return ok
+}
+
+var errZoneNotFound = errors.New("zone not found")
+
+// requireZoneAdmin only lets administrators of the organisation of the zone in
+// the path through, it has to come after RequireAuthentication
+var requireZoneAdmin = helpers.RequireOrganisationAdmin(func(r *http.Request) string {
+	z, _ := zones.get(chi.URLParam(r, "uuid"))
+	return z.Organisation
+})
+
+func getZones(w http.ResponseWriter, r *http.Request) {
+	helpers.WriteSuccessJson(w, r, zones.all())
+}
+
+func getZone(w http.ResponseWriter, r *http.Request) {
+	z, ok := zones.get(chi.URLParam(r, "uuid"))
+	if !ok {
+		helpers.WriteErrorJson(w, r, errZoneNotFound)
+		return
+	}
+
+	helpers.WriteSuccessJson(w, r, z)
+}
+
+func createZone(w http.ResponseWriter, r *http.Request) {
+	var req zone
+
+	err := helpers.GetJsonFromRequestBody(r, &req)
+	if err != nil {
+		helpers.WriteErrorJson(w, r, err)
+		return
+	}
+
+	if err := req.validate(); err != nil {
+		helpers.WriteErrorJson(w, r, err)
+		return
+	}
+
+	if !helpers.IsOrganisationAdmin(r, req.Organisation) {
+		helpers.WriteErrorJsonStatus(w, r, http.StatusForbidden, errors.New("only administrators of the organisation can do this"))
+		return
+	}
+
+	req.Uuid = helpers.NewUuid()
+	zones.put(req)
+
+	helpers.WriteSuccessJson(w, r, req)
+}
+
+func updateZone(w http.ResponseWriter, r *http.Request) {
+	uuid := chi.URLParam(r, "uuid")
+
+	existing, ok := zones.get(uuid)
+	if !ok {
+		helpers.WriteErrorJson(w, r, errZoneNotFound)
+		return
+	}
+
+	var req zone
+
+	err := helpers.GetJsonFromRequestBody(r, &req)
+	if err != nil {
+		helpers.WriteErrorJson(w, r, err)
+		return
+	}
+
+	if req.Organisation == "" {
+		req.Organisation = existing.Organisation
+	}
+	if err := req.validate(); err != nil {
+		helpers.WriteErrorJson(w, r, err)
+		return
+	}
+
+	// only administrators of the edge can hand a zone to another organisation
+	if req.Organisation != existing.Organisation && !helpers.IsAdmin(r) {
+		helpers.WriteErrorJsonStatus(w, r, http.StatusForbidden, errors.New("the organisation of a zone cannot be changed"))
+		return
+	}
+
+	req.Uuid = uuid
+	zones.put(req)
+	// the shape may have changed, start over for this zone
+	fences.forgetZone(uuid)
+
+	helpers.WriteSuccessJson(w, r, req)
+}
+
+func deleteZone(w http.ResponseWriter, r *http.Request) {
+	uuid := chi.URLParam(r, "uuid")
+
+	if !zones.delete(uuid) {
+		helpers.WriteErrorJson(w, r, errZoneNotFound)
+		return
+	}
+	fences.forgetZone(uuid)
+
+	helpers.WriteSuccess(w, r)
+}
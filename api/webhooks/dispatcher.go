@@ -0,0 +1,168 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/acubed-tm/edge/helpers"
+)
+
+// Events are posted as JSON with these headers:
+//
+//	X-Acubed-Event      event type
+//	X-Acubed-Delivery   uuid of the delivery attempt
+//	X-Acubed-Signature  t=<unix time>,v1=<hex HMAC-SHA256 of "<t>.<body>" with the subscription secret>
+//
+// Receivers should check the signature and reject old timestamps. Failed
+// deliveries are retried with exponential backoff and end up in the dead letters
+// of the organisation after the last attempt.
+
+type job struct {
+	subscription subscription
+	event        Event
+	attempt      int
+}
+
+type webhookDispatcher struct {
+	client      *http.Client
+	queue       chan job
+	workers     int
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	start       sync.Once
+}
+
+var dispatcher = &webhookDispatcher{
+	client:      newReceiverClient(helpers.GetEnvDuration("WEBHOOK_TIMEOUT", 10*time.Second), allowPrivateReceivers),
+	queue:       make(chan job, helpers.GetEnvInt("WEBHOOK_QUEUE_SIZE", 1000)),
+	workers:     helpers.GetEnvInt("WEBHOOK_WORKERS", 4),
+	maxAttempts: helpers.GetEnvInt("WEBHOOK_MAX_ATTEMPTS", 6),
+	backoff:     helpers.GetEnvDuration("WEBHOOK_BACKOFF", time.Second),
+	maxBackoff:  helpers.GetEnvDuration("WEBHOOK_MAX_BACKOFF", 5*time.Minute),
+}
+
+func (d *webhookDispatcher) enqueue(j job) {
+	d.start.Do(func() {
+		for i := 0; i < d.workers; i++ {
+			go d.work()
+		}
+	})
+
+	select {
+	case d.queue <- j:
+	default:
+		log.Printf("Webhook queue is full, dead-lettering event %s", j.event.Uuid)
+		d.deadLetter(j, "webhook queue is full")
+	}
+}
+
+func (d *webhookDispatcher) work() {
+	for j := range d.queue {
+		d.deliver(j)
+	}
+}
+
+func (d *webhookDispatcher) deliver(j job) {
+	attempt := delivery{
+		Uuid:      helpers.NewUuid(),
+		EventUuid: j.event.Uuid,
+		EventType: j.event.Type,
+		Attempt:   j.attempt,
+		Time:      time.Now().UTC(),
+	}
+
+	statusCode, err := d.post(j, attempt.Uuid)
+	attempt.Duration = time.Since(attempt.Time).Milliseconds()
+	attempt.StatusCode = statusCode
+	if err == nil && (statusCode < 200 || statusCode > 299) {
+		err = fmt.Errorf("receiver responded with %d", statusCode)
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	subscriptions.logDelivery(j.subscription.Uuid, attempt)
+
+	if err == nil {
+		return
+	}
+
+	if j.attempt >= d.maxAttempts {
+		log.Printf("Giving up on event %s for subscription %s: %v", j.event.Uuid, j.subscription.Uuid, err)
+		d.deadLetter(j, err.Error())
+		return
+	}
+
+	wait := d.backoffFor(j.attempt)
+	log.Printf("Delivery of event %s to %s failed, retrying in %v: %v", j.event.Uuid, j.subscription.Url, wait, err)
+	j.attempt++
+	time.AfterFunc(wait, func() { d.enqueue(j) })
+}
+
+func (d *webhookDispatcher) post(j job, deliveryUuid string) (int, error) {
+	body, err := json.Marshal(j.event)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest("POST", j.subscription.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "acubed-edge-webhooks")
+	req.Header.Set("X-Acubed-Event", j.event.Type)
+	req.Header.Set("X-Acubed-Delivery", deliveryUuid)
+	req.Header.Set("X-Acubed-Signature", sign(j.subscription.Secret, time.Now(), body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// backoffFor doubles the wait for every attempt, with jitter so retries of many
+// deliveries don't all arrive at once
+func (d *webhookDispatcher) backoffFor(attempt int) time.Duration {
+	wait := d.backoff
+	for i := 1; i < attempt && wait < d.maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > d.maxBackoff {
+		wait = d.maxBackoff
+	}
+	half := int64(wait / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+func (d *webhookDispatcher) deadLetter(j job, reason string) {
+	subscriptions.addDeadLetter(j.subscription.Organisation, deadLetter{
+		Uuid:             helpers.NewUuid(),
+		SubscriptionUuid: j.subscription.Uuid,
+		Event:            j.event,
+		Attempts:         j.attempt,
+		LastError:        reason,
+		Time:             time.Now().UTC(),
+	})
+}
+
+func sign(secret string, t time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
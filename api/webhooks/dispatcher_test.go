@@ -0,0 +1,265 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// receiver is a local webhook receiver that fails the first failures requests
+type receiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	failures int
+	requests []*http.Request
+	bodies   [][]byte
+	times    []time.Time
+	received chan struct{}
+}
+
+func newReceiver(failures int) *receiver {
+	rec := &receiver{failures: failures, received: make(chan struct{}, 100)}
+	rec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		rec.mu.Lock()
+		rec.requests = append(rec.requests, r)
+		rec.bodies = append(rec.bodies, body)
+		rec.times = append(rec.times, time.Now())
+		fail := len(rec.requests) <= rec.failures
+		rec.mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		rec.received <- struct{}{}
+	}))
+	return rec
+}
+
+func (rec *receiver) wait(t *testing.T, n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case <-rec.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("receiver got %d of %d requests", i, n)
+		}
+	}
+}
+
+// useTestDispatcher replaces the dispatcher and subscriptions with ones that
+// deliver to local receivers and retry quickly, returning a function to undo it
+func useTestDispatcher(maxAttempts int) func() {
+	oldDispatcher := dispatcher
+	dispatcher = &webhookDispatcher{
+		client:      newReceiverClient(time.Second, true),
+		queue:       make(chan job, 10),
+		workers:     1,
+		maxAttempts: maxAttempts,
+		backoff:     20 * time.Millisecond,
+		maxBackoff:  40 * time.Millisecond,
+	}
+	// workers of earlier tests may still be logging, so the store is emptied
+	// rather than replaced
+	subscriptions.mu.Lock()
+	subscriptions.subscriptions = map[string]subscription{}
+	subscriptions.deliveries = map[string][]delivery{}
+	subscriptions.deadLetters = map[string][]deadLetter{}
+	subscriptions.mu.Unlock()
+	return func() { dispatcher = oldDispatcher }
+}
+
+func subscribe(url string) subscription {
+	sub := subscription{Uuid: "sub", Organisation: "org", Url: url, Events: []string{"zone.*"}, Secret: "secret"}
+	subscriptions.put(sub)
+	return sub
+}
+
+// eventually waits until cond is true
+func eventually(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"type":"zone.enter"}`)
+	got := sign("secret", time.Unix(1600000000, 0), body)
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("1600000000." + string(body)))
+	want := "t=1600000000,v1=" + hex.EncodeToString(mac.Sum(nil))
+	if got != want {
+		t.Errorf("sign() = %s, want %s", got, want)
+	}
+	if sign("other", time.Unix(1600000000, 0), body) == got {
+		t.Error("sign() gave the same signature for another secret")
+	}
+}
+
+func TestDeliverySignature(t *testing.T) {
+	defer useTestDispatcher(1)()
+	rec := newReceiver(0)
+	defer rec.Close()
+	sub := subscribe(rec.URL)
+
+	Publish("org", ZoneEnter, map[string]string{"zone": "z"})
+	rec.wait(t, 1)
+	eventually(t, "the delivery log", func() bool { return len(subscriptions.deliveryLog(sub.Uuid)) == 1 })
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	r, body := rec.requests[0], rec.bodies[0]
+	if r.Header.Get("X-Acubed-Event") != ZoneEnter || r.Header.Get("X-Acubed-Delivery") == "" {
+		t.Errorf("unexpected headers %v", r.Header)
+	}
+
+	// verify like a receiver would
+	parts := strings.Split(r.Header.Get("X-Acubed-Signature"), ",")
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "t=") || !strings.HasPrefix(parts[1], "v1=") {
+		t.Fatalf("malformed signature %q", r.Header.Get("X-Acubed-Signature"))
+	}
+	timestamp, err := strconv.ParseInt(strings.TrimPrefix(parts[0], "t="), 10, 64)
+	if err != nil || time.Since(time.Unix(timestamp, 0)) > time.Minute {
+		t.Errorf("signature timestamp %s is not current", parts[0])
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(strings.TrimPrefix(parts[0], "t=") + "." + string(body)))
+	if !hmac.Equal([]byte(strings.TrimPrefix(parts[1], "v1=")), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		t.Error("signature doesn't match the body")
+	}
+}
+
+func TestDeliveryRetriesWithBackoff(t *testing.T) {
+	defer useTestDispatcher(5)()
+	rec := newReceiver(2)
+	defer rec.Close()
+	sub := subscribe(rec.URL)
+
+	Publish("org", ZoneExit, nil)
+	rec.wait(t, 3)
+	eventually(t, "the delivery log", func() bool { return len(subscriptions.deliveryLog(sub.Uuid)) == 3 })
+
+	log := subscriptions.deliveryLog(sub.Uuid)
+	for i, d := range log {
+		if d.Attempt != i+1 {
+			t.Errorf("delivery %d has attempt %d", i, d.Attempt)
+		}
+	}
+	if log[0].StatusCode != 500 || log[0].Error == "" || log[2].StatusCode != 200 || log[2].Error != "" {
+		t.Errorf("unexpected delivery log %+v", log)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	// the backoff has jitter, but is at least half of the wait
+	if wait := rec.times[1].Sub(rec.times[0]); wait < 10*time.Millisecond {
+		t.Errorf("first retry came after %v", wait)
+	}
+	if wait := rec.times[2].Sub(rec.times[1]); wait < 20*time.Millisecond {
+		t.Errorf("second retry came after %v", wait)
+	}
+	if len(subscriptions.deadLetterList("org")) != 0 {
+		t.Error("delivered event was dead-lettered")
+	}
+}
+
+func TestBackoffFor(t *testing.T) {
+	d := &webhookDispatcher{backoff: time.Second, maxBackoff: 5 * time.Second}
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{10, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			if wait := d.backoffFor(tt.attempt); wait < tt.max/2 || wait > tt.max {
+				t.Errorf("backoffFor(%d) = %v, want between %v and %v", tt.attempt, wait, tt.max/2, tt.max)
+			}
+		}
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	defer useTestDispatcher(3)()
+	rec := newReceiver(100)
+	defer rec.Close()
+	sub := subscribe(rec.URL)
+
+	Publish("org", ZoneDwell, nil)
+	rec.wait(t, 3)
+	eventually(t, "the dead letter", func() bool { return len(subscriptions.deadLetterList("org")) == 1 })
+
+	letter := subscriptions.deadLetterList("org")[0]
+	if letter.SubscriptionUuid != sub.Uuid || letter.Attempts != 3 || letter.Event.Type != ZoneDwell {
+		t.Errorf("unexpected dead letter %+v", letter)
+	}
+
+	retry := func() {
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("organisation", "org")
+		rctx.URLParams.Add("uuid", letter.Uuid)
+		r := httptest.NewRequest("POST", "/", nil)
+		retryDeadLetter(httptest.NewRecorder(), r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx)))
+	}
+
+	// without its subscription the letter can't be retried, but isn't lost
+	subscriptions.delete("org", sub.Uuid)
+	retry()
+	if len(subscriptions.deadLetterList("org")) != 1 {
+		t.Fatal("dead letter of a deleted subscription was dropped")
+	}
+
+	subscriptions.put(sub)
+	rec.mu.Lock()
+	rec.failures = 0
+	rec.mu.Unlock()
+	retry()
+	rec.wait(t, 1)
+	if len(subscriptions.deadLetterList("org")) != 0 {
+		t.Error("retried dead letter is still there")
+	}
+}
+
+func TestPublishAll(t *testing.T) {
+	defer useTestDispatcher(1)()
+	org, all := newReceiver(0), newReceiver(0)
+	defer org.Close()
+	defer all.Close()
+	subscriptions.put(subscription{Uuid: "org", Organisation: "org", Url: org.URL, Events: []string{"*"}, Secret: "secret"})
+	subscriptions.put(subscription{Uuid: "all", Organisation: AllOrganisations, Url: all.URL, Events: []string{"*"}, Secret: "secret"})
+
+	PublishAll([]string{"org", "other"}, EmailAdded, nil)
+	PublishAll(nil, AccountRegistered, nil)
+	org.wait(t, 1)
+	all.wait(t, 1)
+
+	for _, tt := range []struct {
+		rec  *receiver
+		want string
+	}{{org, EmailAdded}, {all, AccountRegistered}} {
+		tt.rec.mu.Lock()
+		if len(tt.rec.requests) != 1 || tt.rec.requests[0].Header.Get("X-Acubed-Event") != tt.want {
+			t.Errorf("receiver got %d requests, want only %s", len(tt.rec.requests), tt.want)
+		}
+		tt.rec.mu.Unlock()
+	}
+}
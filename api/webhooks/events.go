@@ -0,0 +1,88 @@
+package webhooks
+
+import (
+	"strings"
+	"time"
+
+	"github.com/acubed-tm/edge/helpers"
+)
+
+// Event types that can be subscribed to
+const (
+	CaptureReceived            = "capture.received"
+	ObjectReappeared           = "object.reappeared"
+	ZoneEnter                  = "zone.enter"
+	ZoneExit                   = "zone.exit"
+	ZoneDwell                  = "zone.dwell"
+	AccountRegistered          = "account.registered"
+	EmailAdded                 = "email.added"
+	UserProfileCreated         = "profile.user.created"
+	UserProfileUpdated         = "profile.user.updated"
+	OrganisationProfileCreated = "profile.organisation.created"
+	OrganisationProfileUpdated = "profile.organisation.updated"
+)
+
+var eventTypes = []string{
+	CaptureReceived,
+	ObjectReappeared,
+	ZoneEnter,
+	ZoneExit,
+	ZoneDwell,
+	AccountRegistered,
+	EmailAdded,
+	UserProfileCreated,
+	UserProfileUpdated,
+	OrganisationProfileCreated,
+	OrganisationProfileUpdated,
+}
+
+func isKnownEventPattern(pattern string) bool {
+	if pattern == "*" {
+		return true
+	}
+	for _, t := range eventTypes {
+		if t == pattern || (strings.HasSuffix(pattern, ".*") && strings.HasPrefix(t, strings.TrimSuffix(pattern, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// Event is the payload posted to subscribers
+type Event struct {
+	Uuid         string      `json:"uuid"`
+	Type         string      `json:"type"`
+	Organisation string      `json:"organisation"`
+	Time         time.Time   `json:"time"`
+	Data         interface{} `json:"data"`
+}
+
+// Publish sends an event to all subscriptions of the organisation that want it.
+// It never blocks, deliveries happen in the background.
+func Publish(organisation, eventType string, data interface{}) {
+	if organisation == "" {
+		organisation = AllOrganisations
+	}
+	e := Event{
+		Uuid:         helpers.NewUuid(),
+		Type:         eventType,
+		Organisation: organisation,
+		Time:         time.Now().UTC(),
+		Data:         data,
+	}
+	for _, sub := range subscriptions.matching(e) {
+		dispatcher.enqueue(job{subscription: sub, event: e, attempt: 1})
+	}
+}
+
+// PublishAll publishes the event to each of the organisations it belongs to,
+// or to AllOrganisations when it belongs to none
+func PublishAll(organisations []string, eventType string, data interface{}) {
+	if len(organisations) == 0 {
+		Publish(AllOrganisations, eventType, data)
+		return
+	}
+	for _, organisation := range organisations {
+		Publish(organisation, eventType, data)
+	}
+}
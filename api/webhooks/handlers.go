@@ -0,0 +1,183 @@
+package webhooks
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/acubed-tm/edge/helpers"
+	"github.com/go-chi/chi"
+)
+
+var (
+	errSubscriptionNotFound = errors.New("subscription not found")
+	errDeadLetterNotFound   = errors.New("dead letter not found")
+)
+
+// requireOrganisationAdmin only lets administrators of the organisation in the
+// path through. Events of AllOrganisations concern every account, so only
+// administrators of the edge can subscribe to them.
+func requireOrganisationAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if chi.URLParam(r, "organisation") == AllOrganisations {
+			helpers.RequireAdmin(next).ServeHTTP(w, r)
+			return
+		}
+		helpers.RequireOrganisationAdmin(func(r *http.Request) string {
+			return chi.URLParam(r, "organisation")
+		})(next).ServeHTTP(w, r)
+	})
+}
+
+func getSubscriptions(w http.ResponseWriter, r *http.Request) {
+	organisation := chi.URLParam(r, "organisation")
+
+	helpers.WriteSuccessJson(w, r, subscriptions.all(organisation))
+}
+
+func getSubscription(w http.ResponseWriter, r *http.Request) {
+	organisation := chi.URLParam(r, "organisation")
+
+	sub, ok := subscriptions.get(organisation, chi.URLParam(r, "uuid"))
+	if !ok {
+		helpers.WriteErrorJson(w, r, errSubscriptionNotFound)
+		return
+	}
+
+	helpers.WriteSuccessJson(w, r, sub.redacted())
+}
+
+func createSubscription(w http.ResponseWriter, r *http.Request) {
+	organisation := chi.URLParam(r, "organisation")
+
+	var req struct {
+		Url    string   `json:"url"`
+		Events []string `json:"events"`
+		Secret string   `json:"secret"` // generated when left empty
+	}
+
+	err := helpers.GetJsonFromRequestBody(r, &req)
+	if err != nil {
+		helpers.WriteErrorJson(w, r, err)
+		return
+	}
+
+	sub := subscription{
+		Uuid:         helpers.NewUuid(),
+		Organisation: organisation,
+		Url:          req.Url,
+		Events:       req.Events,
+		Secret:       req.Secret,
+		Created:      time.Now().UTC(),
+	}
+	if sub.Secret == "" {
+		sub.Secret = newSecret()
+	}
+
+	if err := sub.validate(); err != nil {
+		helpers.WriteErrorJson(w, r, err)
+		return
+	}
+
+	subscriptions.put(sub)
+
+	// the only time the secret is returned
+	helpers.WriteSuccessJson(w, r, sub)
+}
+
+func updateSubscription(w http.ResponseWriter, r *http.Request) {
+	organisation := chi.URLParam(r, "organisation")
+
+	var req struct {
+		Url    string   `json:"url"`
+		Events []string `json:"events"`
+		Secret string   `json:"secret"` // unchanged when left empty
+	}
+
+	err := helpers.GetJsonFromRequestBody(r, &req)
+	if err != nil {
+		helpers.WriteErrorJson(w, r, err)
+		return
+	}
+
+	sub, ok := subscriptions.get(organisation, chi.URLParam(r, "uuid"))
+	if !ok {
+		helpers.WriteErrorJson(w, r, errSubscriptionNotFound)
+		return
+	}
+
+	sub.Url = req.Url
+	sub.Events = req.Events
+	if req.Secret != "" {
+		sub.Secret = req.Secret
+	}
+
+	if err := sub.validate(); err != nil {
+		helpers.WriteErrorJson(w, r, err)
+		return
+	}
+
+	subscriptions.put(sub)
+
+	helpers.WriteSuccessJson(w, r, sub.redacted())
+}
+
+func deleteSubscription(w http.ResponseWriter, r *http.Request) {
+	organisation := chi.URLParam(r, "organisation")
+
+	if !subscriptions.delete(organisation, chi.URLParam(r, "uuid")) {
+		helpers.WriteErrorJson(w, r, errSubscriptionNotFound)
+		return
+	}
+
+	helpers.WriteSuccess(w, r)
+}
+
+func getDeliveries(w http.ResponseWriter, r *http.Request) {
+	organisation := chi.URLParam(r, "organisation")
+
+	sub, ok := subscriptions.get(organisation, chi.URLParam(r, "uuid"))
+	if !ok {
+		helpers.WriteErrorJson(w, r, errSubscriptionNotFound)
+		return
+	}
+
+	helpers.WriteSuccessJson(w, r, subscriptions.deliveryLog(sub.Uuid))
+}
+
+func getDeadLetters(w http.ResponseWriter, r *http.Request) {
+	organisation := chi.URLParam(r, "organisation")
+
+	helpers.WriteSuccessJson(w, r, subscriptions.deadLetterList(organisation))
+}
+
+func retryDeadLetter(w http.ResponseWriter, r *http.Request) {
+	organisation := chi.URLParam(r, "organisation")
+
+	letter, ok := subscriptions.findDeadLetter(organisation, chi.URLParam(r, "uuid"))
+	if !ok {
+		helpers.WriteErrorJson(w, r, errDeadLetterNotFound)
+		return
+	}
+
+	// the letter stays when its subscription is gone, so it can still be read
+	sub, ok := subscriptions.get(organisation, letter.SubscriptionUuid)
+	if !ok {
+		helpers.WriteErrorJson(w, r, errSubscriptionNotFound)
+		return
+	}
+
+	if _, ok := subscriptions.takeDeadLetter(organisation, letter.Uuid); !ok {
+		// retried by another request in the meantime
+		helpers.WriteErrorJson(w, r, errDeadLetterNotFound)
+		return
+	}
+
+	dispatcher.enqueue(job{subscription: sub, event: letter.Event, attempt: 1})
+
+	helpers.WriteSuccess(w, r)
+}
+
+func getEventTypes(w http.ResponseWriter, r *http.Request) {
+	helpers.WriteSuccessJson(w, r, eventTypes)
+}
@@ -0,0 +1,111 @@
+package webhooks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/acubed-tm/edge/helpers"
+)
+
+// Receivers have to be on the public internet, or the edge could be used to
+// reach services inside the cluster. Hostnames of the cluster are refused when
+// subscribing, and the addresses they resolve to are checked again on every
+// delivery, so a public name can't later point inside.
+// WEBHOOK_ALLOW_PRIVATE_RECEIVERS=true lifts this for local development.
+
+var allowPrivateReceivers = helpers.GetEnvBool("WEBHOOK_ALLOW_PRIVATE_RECEIVERS", false)
+
+var errPrivateReceiver = errors.New("webhook receivers must be on a public address")
+
+// suffixes of hostnames that only resolve inside the cluster or the host
+var privateHostSuffixes = []string{".localhost", ".local", ".internal", ".svc", ".acubed"}
+
+var privateNetworks = func() []*net.IPNet {
+	var ret []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/3",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		ret = append(ret, n)
+	}
+	return ret
+}()
+
+func isPublicIp(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// validateReceiver refuses urls that point at the cluster or private networks
+func validateReceiver(rawUrl string, allowPrivate bool) error {
+	u, err := url.Parse(rawUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https url")
+	}
+	if allowPrivate {
+		return nil
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if ip := net.ParseIP(host); ip != nil {
+		if !isPublicIp(ip) {
+			return errPrivateReceiver
+		}
+		return nil
+	}
+	// names without a dot are short names of services in the cluster
+	if host == "localhost" || !strings.Contains(host, ".") {
+		return errPrivateReceiver
+	}
+	for _, suffix := range privateHostSuffixes {
+		if strings.HasSuffix(host, suffix) {
+			return errPrivateReceiver
+		}
+	}
+	return nil
+}
+
+// newReceiverClient returns the client deliveries are posted with, which
+// refuses to connect to private addresses unless allowPrivate is set
+func newReceiverClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if !isPublicIp(net.ParseIP(host)) {
+				return fmt.Errorf("%w: %s", errPrivateReceiver, host)
+			}
+			return nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// a proxy would make the dialer check the proxy instead of the receiver
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
@@ -0,0 +1,55 @@
+package webhooks
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestValidateReceiver(t *testing.T) {
+	tests := []struct {
+		url          string
+		allowPrivate bool
+		wantErr      bool
+	}{
+		{"https://hooks.example.com/acubed", false, false},
+		{"http://203.0.113.7:8080/", false, false},
+		{"ftp://hooks.example.com/", false, true},
+		{"/relative", false, true},
+		{"http://localhost:8080/", false, true},
+		{"http://authentication-service.acubed:50551/", false, true},
+		{"http://tracking-service/", false, true},
+		{"http://edge.default.svc/", false, true},
+		{"http://10.1.2.3/", false, true},
+		{"http://172.20.0.1/", false, true},
+		{"http://192.168.1.1/", false, true},
+		{"http://127.0.0.1/", false, true},
+		{"http://169.254.169.254/latest/meta-data", false, true},
+		{"http://[::1]/", false, true},
+		{"http://[fd00::1]/", false, true},
+		{"http://[::ffff:10.0.0.1]/", false, true},
+		{"http://localhost:8080/", true, false},
+	}
+
+	for _, tt := range tests {
+		err := validateReceiver(tt.url, tt.allowPrivate)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateReceiver(%q) error = %v, wantErr %v", tt.url, err, tt.wantErr)
+		}
+	}
+}
+
+func TestReceiverClientRefusesPrivateAddresses(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer receiver.Close()
+
+	if _, err := newReceiverClient(time.Second, false).Get(receiver.URL); err == nil {
+		t.Error("client connected to a loopback receiver")
+	}
+	resp, err := newReceiverClient(time.Second, true).Get(receiver.URL)
+	if err != nil {
+		t.Fatalf("client with private receivers allowed: %v", err)
+	}
+	_ = resp.Body.Close()
+}
@@ -0,0 +1,27 @@
+package webhooks
+
+import (
+	"github.com/acubed-tm/edge/helpers"
+	"github.com/go-chi/chi"
+)
+
+func Routes() *chi.Mux {
+	router := chi.NewRouter()
+	router.Get("/events", getEventTypes)
+
+	router.Route("/organisation/{organisation}", func(r chi.Router) {
+		r.Use(helpers.RequireAuthentication, requireOrganisationAdmin)
+
+		r.Get("/subscriptions", getSubscriptions)
+		r.Post("/subscriptions", createSubscription)
+		r.Get("/subscription/{uuid}", getSubscription)
+		r.Put("/subscription/{uuid}", updateSubscription)
+		r.Delete("/subscription/{uuid}", deleteSubscription)
+		r.Get("/subscription/{uuid}/deliveries", getDeliveries)
+
+		r.Get("/dead-letters", getDeadLetters)
+		r.Post("/dead-letter/{uuid}/retry", retryDeadLetter)
+	})
+
+	return router
+}
@@ -0,0 +1,225 @@
+package webhooks
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Subscriptions and their delivery state only live in the edge.
+// TODO: persist subscriptions once there is a service to store them in
+
+// AllOrganisations is the organisation of events that don't belong to any
+// organisation, like captures of unregistered cameras or registrations nobody
+// was invited for. Only subscriptions made for it receive those events.
+const AllOrganisations = "*"
+
+// amount of deliveries kept per subscription, and dead letters per organisation
+const (
+	maxDeliveryLog  = 200
+	maxDeadLetters  = 1000
+	secretByteCount = 32
+)
+
+type subscription struct {
+	Uuid         string    `json:"uuid"`
+	Organisation string    `json:"organisation"`
+	Url          string    `json:"url"`
+	Events       []string  `json:"events"` // event types, "*" or a prefix like "zone.*"
+	Secret       string    `json:"secret,omitempty"`
+	Created      time.Time `json:"created"`
+}
+
+func (s subscription) validate() error {
+	if err := validateReceiver(s.Url, allowPrivateReceivers); err != nil {
+		return err
+	}
+	if len(s.Events) == 0 {
+		return errors.New("subscription needs at least one event type")
+	}
+	for _, e := range s.Events {
+		if !isKnownEventPattern(e) {
+			return errors.New("unknown event type " + e)
+		}
+	}
+	return nil
+}
+
+func (s subscription) wants(eventType string) bool {
+	for _, e := range s.Events {
+		if e == "*" || e == eventType {
+			return true
+		}
+		if strings.HasSuffix(e, ".*") && strings.HasPrefix(eventType, strings.TrimSuffix(e, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// redacted hides the secret, it is only shown when the subscription is created
+func (s subscription) redacted() subscription {
+	s.Secret = ""
+	return s
+}
+
+func newSecret() string {
+	b := make([]byte, secretByteCount)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// delivery is a single attempt to deliver an event to a subscription
+type delivery struct {
+	Uuid       string    `json:"uuid"`
+	EventUuid  string    `json:"event"`
+	EventType  string    `json:"type"`
+	Attempt    int       `json:"attempt"`
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Duration   int64     `json:"duration"` // ms
+}
+
+// deadLetter is an event that could not be delivered after all attempts
+type deadLetter struct {
+	Uuid             string    `json:"uuid"`
+	SubscriptionUuid string    `json:"subscription"`
+	Event            Event     `json:"event"`
+	Attempts         int       `json:"attempts"`
+	LastError        string    `json:"lastError"`
+	Time             time.Time `json:"time"`
+}
+
+type store struct {
+	mu            sync.RWMutex
+	subscriptions map[string]subscription
+	deliveries    map[string][]delivery   // subscription uuid -> log, oldest first
+	deadLetters   map[string][]deadLetter // organisation -> dead letters, oldest first
+}
+
+var subscriptions = &store{
+	subscriptions: map[string]subscription{},
+	deliveries:    map[string][]delivery{},
+	deadLetters:   map[string][]deadLetter{},
+}
+
+func (s *store) all(organisation string) []subscription {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ret := []subscription{}
+	for _, sub := range s.subscriptions {
+		if sub.Organisation == organisation {
+			ret = append(ret, sub.redacted())
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Created.Before(ret[j].Created) })
+	return ret
+}
+
+// matching returns the subscriptions that want the event, including secrets
+func (s *store) matching(e Event) []subscription {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var ret []subscription
+	for _, sub := range s.subscriptions {
+		if sub.Organisation == e.Organisation && sub.wants(e.Type) {
+			ret = append(ret, sub)
+		}
+	}
+	return ret
+}
+
+func (s *store) get(organisation, uuid string) (subscription, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sub, ok := s.subscriptions[uuid]
+	if !ok || sub.Organisation != organisation {
+		return subscription{}, false
+	}
+	return sub, true
+}
+
+func (s *store) put(sub subscription) {
+	s.mu.Lock()
+	s.subscriptions[sub.Uuid] = sub
+	s.mu.Unlock()
+}
+
+func (s *store) delete(organisation, uuid string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subscriptions[uuid]
+	if !ok || sub.Organisation != organisation {
+		return false
+	}
+	delete(s.subscriptions, uuid)
+	delete(s.deliveries, uuid)
+	return true
+}
+
+func (s *store) logDelivery(subscriptionUuid string, d delivery) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subscriptions[subscriptionUuid]; !ok {
+		return
+	}
+	log := append(s.deliveries[subscriptionUuid], d)
+	if len(log) > maxDeliveryLog {
+		log = log[len(log)-maxDeliveryLog:]
+	}
+	s.deliveries[subscriptionUuid] = log
+}
+
+func (s *store) deliveryLog(subscriptionUuid string) []delivery {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]delivery{}, s.deliveries[subscriptionUuid]...)
+}
+
+func (s *store) addDeadLetter(organisation string, d deadLetter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	letters := append(s.deadLetters[organisation], d)
+	if len(letters) > maxDeadLetters {
+		letters = letters[len(letters)-maxDeadLetters:]
+	}
+	s.deadLetters[organisation] = letters
+}
+
+func (s *store) deadLetterList(organisation string) []deadLetter {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]deadLetter{}, s.deadLetters[organisation]...)
+}
+
+func (s *store) findDeadLetter(organisation, uuid string) (deadLetter, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, d := range s.deadLetters[organisation] {
+		if d.Uuid == uuid {
+			return d, true
+		}
+	}
+	return deadLetter{}, false
+}
+
+// takeDeadLetter removes a dead letter so it can be delivered again
+func (s *store) takeDeadLetter(organisation, uuid string) (deadLetter, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	letters := s.deadLetters[organisation]
+	for i, d := range letters {
+		if d.Uuid == uuid {
+			s.deadLetters[organisation] = append(letters[:i:i], letters[i+1:]...)
+			return d, true
+		}
+	}
+	return deadLetter{}, false
+}
@@ -0,0 +1,157 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	proto "github.com/acubed-tm/edge/protofiles"
+	"google.golang.org/grpc"
+)
+
+const authService = "authentication-service.acubed:50551"
+
+type contextKey string
+
+const accountUuidKey contextKey = "accountUuid"
+
+// GetAccountUuid asks the authentication service which account a token belongs to
+func GetAccountUuid(token string) (string, error) {
+	accountUuid, err := RunGrpc(authService, func(ctx context.Context, conn *grpc.ClientConn) (interface{}, error) {
+		c := proto.NewAuthServiceClient(conn)
+		resp, err := c.GetUuidFromToken(ctx, &proto.GetUuidFromTokenRequest{Token: token})
+		if err != nil {
+			return nil, err
+		}
+		return resp.Uuid, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return accountUuid.(string), nil
+}
+
+// GetInvitingOrganisations asks the authentication service which organisations invited the email
+func GetInvitingOrganisations(email string) ([]string, error) {
+	organisations, err := RunGrpc(authService, func(ctx context.Context, conn *grpc.ClientConn) (interface{}, error) {
+		c := proto.NewAuthServiceClient(conn)
+		resp, err := c.GetInvitesByEmail(ctx, &proto.GetInvitesByEmailRequest{Email: email})
+		if err != nil {
+			return nil, err
+		}
+		return resp.OrganizationUuids, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return organisations.([]string), nil
+}
+
+// RequireAuthentication only lets requests with a valid token through, the
+// account they belong to is available through GetCurrentAccountUuid
+func RequireAuthentication(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := GetJwtToken(r)
+		if err != nil {
+			WriteErrorJsonStatus(w, r, http.StatusUnauthorized, err)
+			return
+		}
+
+		accountUuid, err := GetAccountUuid(token)
+		if err != nil {
+			WriteErrorJsonStatus(w, r, http.StatusUnauthorized, err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), accountUuidKey, accountUuid)))
+	})
+}
+
+// GetCurrentAccountUuid returns the account of a request that passed
+// RequireAuthentication, or an empty string
+func GetCurrentAccountUuid(r *http.Request) string {
+	accountUuid, _ := r.Context().Value(accountUuidKey).(string)
+	return accountUuid
+}
+
+// accounts that administer the whole edge, as a comma separated list of uuids
+var adminAccounts = GetEnvList("ADMIN_ACCOUNTS", nil)
+
+// IsAdmin is true when the account of a request that passed
+// RequireAuthentication administers the whole edge
+func IsAdmin(r *http.Request) bool {
+	accountUuid := GetCurrentAccountUuid(r)
+	for _, admin := range adminAccounts {
+		if accountUuid != "" && accountUuid == admin {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireAdmin only lets requests of administrators through, it has to come
+// after RequireAuthentication
+func RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsAdmin(r) {
+			WriteErrorJsonStatus(w, r, http.StatusForbidden, errors.New("only administrators can do this"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The authentication service does not tell which accounts belong to an
+// organisation yet, so organisation roles are configured on the edge as comma
+// separated lists of account uuids:
+//
+//	ORGANISATION_<uuid>_ADMINS   administer the organisation
+//	ORGANISATION_<uuid>_MEMBERS  can see what belongs to the organisation
+//
+// Administrators of an organisation are members of it, and administrators of
+// the edge administer every organisation.
+
+func hasOrganisationRole(r *http.Request, organisation string, roles ...string) bool {
+	if IsAdmin(r) {
+		return true
+	}
+	accountUuid := GetCurrentAccountUuid(r)
+	if accountUuid == "" || organisation == "" {
+		return false
+	}
+	for _, role := range roles {
+		for _, account := range GetEnvList(EnvKey("ORGANISATION", organisation, role), nil) {
+			if account == accountUuid {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsOrganisationAdmin is true when the account of a request that passed
+// RequireAuthentication administers the organisation
+func IsOrganisationAdmin(r *http.Request, organisation string) bool {
+	return hasOrganisationRole(r, organisation, "ADMINS")
+}
+
+// IsOrganisationMember is true when the account of a request that passed
+// RequireAuthentication belongs to the organisation
+func IsOrganisationMember(r *http.Request, organisation string) bool {
+	return hasOrganisationRole(r, organisation, "ADMINS", "MEMBERS")
+}
+
+// RequireOrganisationAdmin only lets requests through from administrators of
+// the organisation that organisation returns for the request, it has to come
+// after RequireAuthentication
+func RequireOrganisationAdmin(organisation func(r *http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !IsOrganisationAdmin(r, organisation(r)) {
+				WriteErrorJsonStatus(w, r, http.StatusForbidden, errors.New("only administrators of the organisation can do this"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
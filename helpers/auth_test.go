@@ -0,0 +1,52 @@
+package helpers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func requestOf(accountUuid string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	return r.WithContext(context.WithValue(r.Context(), accountUuidKey, accountUuid))
+}
+
+func TestOrganisationRoles(t *testing.T) {
+	_ = os.Setenv("ORGANISATION_ORG_1_ADMINS", "admin")
+	_ = os.Setenv("ORGANISATION_ORG_1_MEMBERS", "member, other")
+	defer os.Unsetenv("ORGANISATION_ORG_1_ADMINS")
+	defer os.Unsetenv("ORGANISATION_ORG_1_MEMBERS")
+	previous := adminAccounts
+	adminAccounts = []string{"root"}
+	defer func() { adminAccounts = previous }()
+
+	tests := []struct {
+		name         string
+		account      string
+		organisation string
+		wantAdmin    bool
+		wantMember   bool
+	}{
+		{"admin", "admin", "org-1", true, true},
+		{"member", "member", "org-1", false, true},
+		{"second member", "other", "org-1", false, true},
+		{"outsider", "outsider", "org-1", false, false},
+		{"admin of another organisation", "admin", "org-2", false, false},
+		{"edge admin", "root", "org-2", true, true},
+		{"unauthenticated", "", "org-1", false, false},
+		{"no organisation", "admin", "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := requestOf(tt.account)
+			if got := IsOrganisationAdmin(r, tt.organisation); got != tt.wantAdmin {
+				t.Errorf("IsOrganisationAdmin = %v, want %v", got, tt.wantAdmin)
+			}
+			if got := IsOrganisationMember(r, tt.organisation); got != tt.wantMember {
+				t.Errorf("IsOrganisationMember = %v, want %v", got, tt.wantMember)
+			}
+		})
+	}
+}
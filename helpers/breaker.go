@@ -0,0 +1,323 @@
+package helpers
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Circuit breakers stop calling an upstream that keeps failing or is too slow,
+// so requests fail fast instead of all waiting for the timeout. There is one
+// per upstream service, and one per method for the methods in BREAKER_METHODS
+// (eg. "TrackingService/AddCapture,AuthService/Login").
+//
+// A breaker looks at the last BREAKER_WINDOW calls and opens once at least
+// BREAKER_MIN_CALLS were made and either BREAKER_FAILURE_RATE of them failed or
+// BREAKER_SLOW_RATE took longer than BREAKER_SLOW_CALL. After BREAKER_OPEN_FOR
+// it lets BREAKER_PROBES calls through, closing again when they all succeed.
+// Every setting can be overridden per breaker as BREAKER_<NAME>_<SETTING>, eg.
+// BREAKER_TRACKING_SERVICE_OPEN_FOR or BREAKER_AUTHSERVICE_LOGIN_SLOW_CALL.
+
+var ErrCircuitOpen = errors.New("upstream is unavailable, try again later")
+
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+type breakerConfig struct {
+	Window      int           `json:"window"`
+	MinCalls    int           `json:"minCalls"`
+	FailureRate float64       `json:"failureRate"`
+	SlowCall    time.Duration `json:"slowCall"`
+	SlowRate    float64       `json:"slowRate"`
+	OpenFor     time.Duration `json:"openFor"`
+	Probes      int           `json:"probes"`
+}
+
+func loadBreakerConfig(name string) breakerConfig {
+	get := func(setting string) string {
+		return EnvKey("BREAKER", name, setting)
+	}
+	def := breakerConfig{
+		Window:      GetEnvInt("BREAKER_WINDOW", 20),
+		MinCalls:    GetEnvInt("BREAKER_MIN_CALLS", 10),
+		FailureRate: GetEnvFloat("BREAKER_FAILURE_RATE", 0.5),
+		SlowCall:    GetEnvDuration("BREAKER_SLOW_CALL", 2*time.Second),
+		SlowRate:    GetEnvFloat("BREAKER_SLOW_RATE", 0.8),
+		OpenFor:     GetEnvDuration("BREAKER_OPEN_FOR", 10*time.Second),
+		Probes:      GetEnvInt("BREAKER_PROBES", 3),
+	}
+	return breakerConfig{
+		Window:      GetEnvInt(get("WINDOW"), def.Window),
+		MinCalls:    GetEnvInt(get("MIN_CALLS"), def.MinCalls),
+		FailureRate: GetEnvFloat(get("FAILURE_RATE"), def.FailureRate),
+		SlowCall:    GetEnvDuration(get("SLOW_CALL"), def.SlowCall),
+		SlowRate:    GetEnvFloat(get("SLOW_RATE"), def.SlowRate),
+		OpenFor:     GetEnvDuration(get("OPEN_FOR"), def.OpenFor),
+		Probes:      GetEnvInt(get("PROBES"), def.Probes),
+	}
+}
+
+type callResult struct {
+	failed bool
+	slow   bool
+}
+
+type Breaker struct {
+	name   string
+	config breakerConfig
+
+	mu       sync.Mutex
+	state    BreakerState
+	openedAt time.Time
+	results  []callResult // ring of the last calls
+	next     int
+	probes   int // in flight while half-open
+	passed   int // successful probes while half-open
+	rejected uint64
+	trips    uint64
+}
+
+// BreakerSnapshot is the state of a breaker, for the admin endpoint and metrics
+type BreakerSnapshot struct {
+	Name        string        `json:"name"`
+	State       BreakerState  `json:"state"`
+	Calls       int           `json:"calls"`
+	FailureRate float64       `json:"failureRate"`
+	SlowRate    float64       `json:"slowRate"`
+	Rejected    uint64        `json:"rejected"`
+	Trips       uint64        `json:"trips"`
+	OpenedAt    *time.Time    `json:"openedAt,omitempty"`
+	Config      breakerConfig `json:"config"`
+}
+
+var breakers = struct {
+	sync.Mutex
+	byName  map[string]*Breaker
+	methods map[string]bool
+}{
+	byName:  map[string]*Breaker{},
+	methods: map[string]bool{},
+}
+
+func init() {
+	for _, m := range GetEnvList("BREAKER_METHODS", nil) {
+		breakers.methods[m] = true
+	}
+}
+
+// GetBreaker returns the breaker with the name, creating it when needed
+func GetBreaker(name string) *Breaker {
+	breakers.Lock()
+	defer breakers.Unlock()
+	if b, ok := breakers.byName[name]; ok {
+		return b
+	}
+	b := &Breaker{name: name, config: loadBreakerConfig(name), state: BreakerClosed}
+	breakers.byName[name] = b
+	return b
+}
+
+// methodBreaker returns the breaker of a method, or nil when it has none
+func methodBreaker(fullMethod string) *Breaker {
+	name := shortMethodName(fullMethod)
+	breakers.Lock()
+	configured := breakers.methods[name]
+	breakers.Unlock()
+	if !configured {
+		return nil
+	}
+	return GetBreaker(name)
+}
+
+// shortMethodName turns "/acubed.TrackingService/AddCapture" into "TrackingService/AddCapture"
+func shortMethodName(fullMethod string) string {
+	name := strings.TrimPrefix(fullMethod, "/")
+	service := name
+	if i := strings.Index(name, "/"); i != -1 {
+		service = name[:i]
+	}
+	if i := strings.LastIndex(service, "."); i != -1 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// upstreamName turns "tracking-service.acubed:50551" into "tracking-service"
+func upstreamName(ip string) string {
+	name := ip
+	if i := strings.LastIndex(name, ":"); i != -1 {
+		name = name[:i]
+	}
+	if i := strings.Index(name, "."); i != -1 {
+		name = name[:i]
+	}
+	return name
+}
+
+// Allow returns ErrCircuitOpen when the call may not be made. Otherwise done
+// must be called with the outcome of the call.
+func (b *Breaker) Allow() (done func(err error, duration time.Duration), err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen {
+		if time.Since(b.openedAt) < b.config.OpenFor {
+			b.rejected++
+			return nil, ErrCircuitOpen
+		}
+		b.state = BreakerHalfOpen
+		b.probes, b.passed = 0, 0
+	}
+
+	if b.state == BreakerHalfOpen {
+		if b.probes >= b.config.Probes {
+			b.rejected++
+			return nil, ErrCircuitOpen
+		}
+		b.probes++
+	}
+
+	return b.record, nil
+}
+
+func (b *Breaker) record(err error, duration time.Duration) {
+	result := callResult{
+		failed: isUpstreamFailure(err),
+		slow:   b.config.SlowCall > 0 && duration > b.config.SlowCall,
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerHalfOpen:
+		if result.failed || result.slow {
+			b.open()
+			return
+		}
+		b.passed++
+		if b.passed >= b.config.Probes {
+			b.state = BreakerClosed
+			b.results, b.next = nil, 0
+		}
+	case BreakerClosed:
+		if len(b.results) < b.config.Window {
+			b.results = append(b.results, result)
+		} else {
+			b.results[b.next] = result
+			b.next = (b.next + 1) % b.config.Window
+		}
+		if len(b.results) < b.config.MinCalls {
+			return
+		}
+		failureRate, slowRate := b.rates()
+		if failureRate >= b.config.FailureRate || (b.config.SlowRate > 0 && slowRate >= b.config.SlowRate) {
+			b.open()
+		}
+	}
+}
+
+// open must be called with the lock held
+func (b *Breaker) open() {
+	b.state = BreakerOpen
+	b.openedAt = time.Now()
+	b.results, b.next = nil, 0
+	b.trips++
+}
+
+// rates must be called with the lock held
+func (b *Breaker) rates() (float64, float64) {
+	if len(b.results) == 0 {
+		return 0, 0
+	}
+	var failed, slow int
+	for _, r := range b.results {
+		if r.failed {
+			failed++
+		}
+		if r.slow {
+			slow++
+		}
+	}
+	n := float64(len(b.results))
+	return float64(failed) / n, float64(slow) / n
+}
+
+// Reset closes the breaker and forgets its history
+func (b *Breaker) Reset() {
+	b.mu.Lock()
+	b.state = BreakerClosed
+	b.results, b.next = nil, 0
+	b.mu.Unlock()
+}
+
+func (b *Breaker) Snapshot() BreakerSnapshot {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	failureRate, slowRate := b.rates()
+	s := BreakerSnapshot{
+		Name:        b.name,
+		State:       b.state,
+		Calls:       len(b.results),
+		FailureRate: failureRate,
+		SlowRate:    slowRate,
+		Rejected:    b.rejected,
+		Trips:       b.trips,
+		Config:      b.config,
+	}
+	if b.state != BreakerClosed {
+		openedAt := b.openedAt
+		s.OpenedAt = &openedAt
+	}
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.config.OpenFor {
+		// it will let probes through on the next call
+		s.State = BreakerHalfOpen
+	}
+	return s
+}
+
+// BreakerSnapshots returns the state of all breakers, sorted by name
+func BreakerSnapshots() []BreakerSnapshot {
+	breakers.Lock()
+	all := make([]*Breaker, 0, len(breakers.byName))
+	for _, b := range breakers.byName {
+		all = append(all, b)
+	}
+	breakers.Unlock()
+
+	ret := make([]BreakerSnapshot, len(all))
+	for i, b := range all {
+		ret[i] = b.Snapshot()
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+// isUpstreamFailure tells errors that say something about the health of the
+// upstream apart from ones about the request, like a wrong password. Errors
+// wrapped with %w keep their status.
+func isUpstreamFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var s interface{ GRPCStatus() *status.Status }
+	if !errors.As(err, &s) {
+		// not from grpc, eg. a failed dial
+		return true
+	}
+	switch s.GRPCStatus().Code() {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown, codes.ResourceExhausted, codes.DataLoss:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,192 @@
+package helpers
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var testBreakerConfig = breakerConfig{
+	Window:      4,
+	MinCalls:    4,
+	FailureRate: 0.5,
+	SlowCall:    time.Second,
+	SlowRate:    0.75,
+	OpenFor:     time.Hour,
+	Probes:      2,
+}
+
+// outcomes of calls made through a breaker in the tests
+var (
+	callOk       = breakerCall{}
+	callFailed   = breakerCall{err: status.Error(codes.Unavailable, "down")}
+	callRejected = breakerCall{err: status.Error(codes.NotFound, "no such user")}
+	callSlow     = breakerCall{duration: 2 * time.Second}
+)
+
+type breakerCall struct {
+	err      error
+	duration time.Duration
+}
+
+func TestBreakerTrips(t *testing.T) {
+	tests := []struct {
+		name  string
+		calls []breakerCall
+		want  BreakerState
+	}{
+		{"no calls", nil, BreakerClosed},
+		{"successes", []breakerCall{callOk, callOk, callOk, callOk, callOk}, BreakerClosed},
+		{"below min calls", []breakerCall{callFailed, callFailed, callFailed}, BreakerClosed},
+		{"failure rate", []breakerCall{callOk, callFailed, callOk, callFailed}, BreakerOpen},
+		{"below failure rate", []breakerCall{callOk, callFailed, callOk, callOk}, BreakerClosed},
+		{"request errors", []breakerCall{callRejected, callRejected, callRejected, callRejected}, BreakerClosed},
+		{"slow rate", []breakerCall{callSlow, callSlow, callOk, callSlow}, BreakerOpen},
+		{"below slow rate", []breakerCall{callSlow, callSlow, callOk, callOk}, BreakerClosed},
+		{"trips once min calls are reached", []breakerCall{callFailed, callFailed, callFailed, callOk, callOk, callOk, callOk}, BreakerOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Breaker{name: "test", config: testBreakerConfig, state: BreakerClosed}
+			for _, c := range tt.calls {
+				done, err := b.Allow()
+				if err != nil {
+					break
+				}
+				done(c.err, c.duration)
+			}
+			if got := b.Snapshot().State; got != tt.want {
+				t.Errorf("state = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBreakerWindowSlides(t *testing.T) {
+	b := &Breaker{name: "test", config: testBreakerConfig, state: BreakerClosed}
+	for _, c := range []breakerCall{callFailed, callOk, callOk, callOk, callOk, callOk} {
+		done, err := b.Allow()
+		if err != nil {
+			t.Fatal(err)
+		}
+		done(c.err, c.duration)
+	}
+	if s := b.Snapshot(); s.Calls != 4 || s.FailureRate != 0 {
+		t.Errorf("calls = %d, failure rate = %v, want the last 4 calls without failures", s.Calls, s.FailureRate)
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	tests := []struct {
+		name   string
+		probes []breakerCall
+		want   BreakerState
+	}{
+		{"probes pass", []breakerCall{callOk, callOk}, BreakerClosed},
+		{"probe fails", []breakerCall{callOk, callFailed}, BreakerOpen},
+		{"probe is slow", []breakerCall{callSlow}, BreakerOpen},
+		{"probe is rejected by the upstream", []breakerCall{callRejected, callOk}, BreakerClosed},
+		{"probes in flight", nil, BreakerHalfOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Breaker{name: "test", config: testBreakerConfig, state: BreakerClosed}
+			b.mu.Lock()
+			b.open()
+			b.openedAt = time.Now().Add(-2 * time.Hour)
+			b.mu.Unlock()
+
+			var dones []func(error, time.Duration)
+			for i := 0; i < testBreakerConfig.Probes; i++ {
+				done, err := b.Allow()
+				if err != nil {
+					t.Fatalf("probe %d: %v", i, err)
+				}
+				dones = append(dones, done)
+			}
+			if _, err := b.Allow(); err != ErrCircuitOpen {
+				t.Errorf("call beyond the probes: err = %v, want %v", err, ErrCircuitOpen)
+			}
+
+			for i, c := range tt.probes {
+				dones[i](c.err, c.duration)
+			}
+			if got := b.Snapshot().State; got != tt.want {
+				t.Errorf("state = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBreakerOpenRejects(t *testing.T) {
+	b := &Breaker{name: "test", config: testBreakerConfig, state: BreakerClosed}
+	b.mu.Lock()
+	b.open()
+	b.mu.Unlock()
+
+	for i := 0; i < 3; i++ {
+		if _, err := b.Allow(); err != ErrCircuitOpen {
+			t.Fatalf("err = %v, want %v", err, ErrCircuitOpen)
+		}
+	}
+	if s := b.Snapshot(); s.Rejected != 3 || s.Trips != 1 {
+		t.Errorf("rejected = %d, trips = %d, want 3 and 1", s.Rejected, s.Trips)
+	}
+
+	b.Reset()
+	if _, err := b.Allow(); err != nil {
+		t.Errorf("err after reset = %v, want nil", err)
+	}
+}
+
+func TestIsUpstreamFailure(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("connection refused"), true},
+		{status.Error(codes.Unavailable, ""), true},
+		{status.Error(codes.DeadlineExceeded, ""), true},
+		{status.Error(codes.Internal, ""), true},
+		{status.Error(codes.Unknown, ""), true},
+		{status.Error(codes.ResourceExhausted, ""), true},
+		{status.Error(codes.NotFound, ""), false},
+		{status.Error(codes.InvalidArgument, ""), false},
+		{status.Error(codes.PermissionDenied, ""), false},
+		{status.Error(codes.AlreadyExists, ""), false},
+		{status.Error(codes.Canceled, ""), false},
+	}
+	for _, tt := range tests {
+		if got := isUpstreamFailure(tt.err); got != tt.want {
+			t.Errorf("isUpstreamFailure(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestBreakerNames(t *testing.T) {
+	methods := map[string]string{
+		"/acubed.TrackingService/AddCapture": "TrackingService/AddCapture",
+		"/AuthService/Login":                 "AuthService/Login",
+		"AuthService/Login":                  "AuthService/Login",
+	}
+	for method, want := range methods {
+		if got := shortMethodName(method); got != want {
+			t.Errorf("shortMethodName(%q) = %q, want %q", method, got, want)
+		}
+	}
+
+	upstreams := map[string]string{
+		"tracking-service.acubed:50551": "tracking-service",
+		"auth-service:50551":            "auth-service",
+		"localhost":                     "localhost",
+	}
+	for ip, want := range upstreams {
+		if got := upstreamName(ip); got != want {
+			t.Errorf("upstreamName(%q) = %q, want %q", ip, got, want)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package helpers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Caches sit in front of upstream reads. Identical reads that are in flight at
+// the same time are coalesced into a single upstream call, and when
+// CACHE_TTL_<NAME> is set the result is also kept for that long. Writes that
+// make a cached read outdated invalidate it.
+//
+// When CACHE_MAX_STALE_<NAME> is set, the last good result of every key is
+// kept that long, and served as stale when the upstream fails.
+
+type CacheStatus string
+
+const (
+	CacheHit   CacheStatus = "HIT"
+	CacheMiss  CacheStatus = "MISS"
+	CacheStale CacheStatus = "STALE"
+)
+
+// CacheInfo tells how a read was answered
+type CacheInfo struct {
+	Status CacheStatus
+	Age    time.Duration
+}
+
+// expired entries are swept once a cache holds more than this many
+const cacheSweepSize = 10000
+
+type Cache struct {
+	name     string
+	ttl      time.Duration
+	maxStale time.Duration
+
+	mu       sync.Mutex
+	entries  map[string]cacheEntry
+	lastGood map[string]cacheEntry
+	calls    map[string]*cacheCall
+	// bumped on invalidation, so calls that started before don't store their result
+	generations   map[string]uint64
+	generationAll uint64
+}
+
+type cacheEntry struct {
+	value   interface{}
+	stored  time.Time
+	expires time.Time
+}
+
+type cacheCall struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+var caches = struct {
+	sync.Mutex
+	byName map[string]*Cache
+}{byName: map[string]*Cache{}}
+
+// NewCache creates the cache with the name, or returns it if it already exists
+func NewCache(name string) *Cache {
+	caches.Lock()
+	defer caches.Unlock()
+	if c, ok := caches.byName[name]; ok {
+		return c
+	}
+	c := &Cache{
+		name:        name,
+		ttl:         GetEnvDuration("CACHE_TTL_"+strings.ToUpper(name), 0),
+		maxStale:    GetEnvDuration("CACHE_MAX_STALE_"+strings.ToUpper(name), 0),
+		entries:     map[string]cacheEntry{},
+		lastGood:    map[string]cacheEntry{},
+		calls:       map[string]*cacheCall{},
+		generations: map[string]uint64{},
+	}
+	caches.byName[name] = c
+	return c
+}
+
+// Get returns the cached value for the key, or calls fetch to get it. Callers
+// must not modify the value, it is shared with other requests.
+func (c *Cache) Get(key string, fetch func() (interface{}, error)) (interface{}, CacheInfo, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		if now.Before(e.expires) {
+			c.mu.Unlock()
+			return e.value, CacheInfo{Status: CacheHit, Age: now.Sub(e.stored)}, nil
+		}
+		delete(c.entries, key)
+	}
+
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		if call.err != nil {
+			return c.stale(key, call.err)
+		}
+		return call.value, CacheInfo{Status: CacheMiss}, nil
+	}
+
+	call := &cacheCall{done: make(chan struct{})}
+	c.calls[key] = call
+	generation := c.generations[key] + c.generationAll
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		if c.calls[key] == call {
+			delete(c.calls, key)
+		}
+		if call.err == nil && generation == c.generations[key]+c.generationAll {
+			c.store(key, call.value)
+		}
+		c.mu.Unlock()
+		close(call.done)
+	}()
+
+	call.value, call.err = fetch()
+	if call.err != nil {
+		return c.stale(key, call.err)
+	}
+	return call.value, CacheInfo{Status: CacheMiss}, nil
+}
+
+// stale returns the last good value of the key after the upstream failed with
+// err, as long as it isn't older than the maximum staleness. Errors about the
+// request itself, like a missing key, are returned as they are.
+func (c *Cache) stale(key string, err error) (interface{}, CacheInfo, error) {
+	if !isUpstreamFailure(err) && !errors.Is(err, ErrCircuitOpen) {
+		return nil, CacheInfo{Status: CacheMiss}, err
+	}
+
+	c.mu.Lock()
+	e, ok := c.lastGood[key]
+	c.mu.Unlock()
+
+	age := time.Since(e.stored)
+	if !ok || age > c.maxStale {
+		return nil, CacheInfo{Status: CacheMiss}, err
+	}
+	log.Printf("Serving stale %s for %q after error: %v", c.name, key, err)
+	return e.value, CacheInfo{Status: CacheStale, Age: age}, nil
+}
+
+// store must be called with the lock held
+func (c *Cache) store(key string, value interface{}) {
+	now := time.Now()
+	e := cacheEntry{value: value, stored: now, expires: now.Add(c.ttl)}
+
+	if c.ttl > 0 {
+		if len(c.entries) >= cacheSweepSize {
+			for k, e := range c.entries {
+				if now.After(e.expires) {
+					delete(c.entries, k)
+				}
+			}
+		}
+		c.entries[key] = e
+	}
+
+	if c.maxStale > 0 {
+		if len(c.lastGood) >= cacheSweepSize {
+			for k, e := range c.lastGood {
+				if now.Sub(e.stored) > c.maxStale {
+					delete(c.lastGood, k)
+				}
+			}
+		}
+		c.lastGood[key] = e
+	}
+}
+
+func (c *Cache) Invalidate(key string) {
+	c.mu.Lock()
+	delete(c.entries, key)
+	delete(c.lastGood, key)
+	delete(c.calls, key)
+	c.generations[key]++
+	c.mu.Unlock()
+}
+
+func (c *Cache) InvalidateAll() {
+	c.mu.Lock()
+	c.entries = map[string]cacheEntry{}
+	c.lastGood = map[string]cacheEntry{}
+	c.calls = map[string]*cacheCall{}
+	c.generationAll++
+	c.mu.Unlock()
+}
+
+// WriteCacheHeaders tells the client how the response was answered
+func WriteCacheHeaders(w http.ResponseWriter, info CacheInfo) {
+	if info.Status == "" {
+		return
+	}
+	w.Header().Set("X-Cache", string(info.Status))
+	if info.Status != CacheMiss {
+		w.Header().Set("Age", strconv.Itoa(int(info.Age.Seconds())))
+	}
+	if info.Status == CacheStale {
+		w.Header().Set("X-Stale", "true")
+		w.Header().Set("Warning", `111 edge "Revalidation Failed"`)
+	}
+}
@@ -0,0 +1,111 @@
+package helpers
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestCache(ttl, maxStale time.Duration) *Cache {
+	return &Cache{
+		name:        "test",
+		ttl:         ttl,
+		maxStale:    maxStale,
+		entries:     map[string]cacheEntry{},
+		lastGood:    map[string]cacheEntry{},
+		calls:       map[string]*cacheCall{},
+		generations: map[string]uint64{},
+	}
+}
+
+func fetchValue(value interface{}) func() (interface{}, error) {
+	return func() (interface{}, error) { return value, nil }
+}
+
+func fetchError(err error) func() (interface{}, error) {
+	return func() (interface{}, error) { return nil, err }
+}
+
+func TestCacheStale(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus CacheStatus
+	}{
+		{"unavailable", status.Error(codes.Unavailable, "down"), CacheStale},
+		{"deadline", status.Error(codes.DeadlineExceeded, "slow"), CacheStale},
+		{"circuit open", ErrCircuitOpen, CacheStale},
+		{"dial", errors.New("connection refused"), CacheStale},
+		{"not found", status.Error(codes.NotFound, "gone"), CacheMiss},
+		{"wrapped not found", fmt.Errorf("profile: %w", status.Error(codes.NotFound, "gone")), CacheMiss},
+		{"wrapped unavailable", fmt.Errorf("profile: %w", status.Error(codes.Unavailable, "down")), CacheStale},
+		{"permission denied", status.Error(codes.PermissionDenied, "no"), CacheMiss},
+		{"invalid argument", status.Error(codes.InvalidArgument, "bad"), CacheMiss},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(0, time.Hour)
+			if _, _, err := c.Get("key", fetchValue("good")); err != nil {
+				t.Fatal(err)
+			}
+
+			value, info, err := c.Get("key", fetchError(tt.err))
+			if info.Status != tt.wantStatus {
+				t.Errorf("status = %s, want %s", info.Status, tt.wantStatus)
+			}
+			if tt.wantStatus == CacheStale && (err != nil || value != "good") {
+				t.Errorf("got %v, %v, want the last good value", value, err)
+			}
+			if tt.wantStatus == CacheMiss && err != tt.err {
+				t.Errorf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCacheStaleExpires(t *testing.T) {
+	c := newTestCache(0, time.Hour)
+	c.Get("key", fetchValue("good"))
+	e := c.lastGood["key"]
+	e.stored = e.stored.Add(-2 * time.Hour)
+	c.lastGood["key"] = e
+
+	upstreamErr := status.Error(codes.Unavailable, "down")
+	if _, info, err := c.Get("key", fetchError(upstreamErr)); err != upstreamErr || info.Status != CacheMiss {
+		t.Errorf("got %s, %v, want the error after the maximum staleness", info.Status, err)
+	}
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	upstreamErr := status.Error(codes.Unavailable, "down")
+	tests := []struct {
+		name       string
+		invalidate func(c *Cache)
+	}{
+		{"key", func(c *Cache) { c.Invalidate("key") }},
+		{"all", func(c *Cache) { c.InvalidateAll() }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(time.Hour, time.Hour)
+			c.Get("key", fetchValue("old"))
+			if _, info, _ := c.Get("key", fetchValue("new")); info.Status != CacheHit {
+				t.Fatalf("status = %s, want %s", info.Status, CacheHit)
+			}
+
+			tt.invalidate(c)
+
+			// neither the entry nor the last good value may be served after a write
+			if _, info, err := c.Get("key", fetchError(upstreamErr)); err != upstreamErr || info.Status != CacheMiss {
+				t.Errorf("got %s, %v, want the upstream error", info.Status, err)
+			}
+			if value, info, _ := c.Get("key", fetchValue("new")); value != "new" || info.Status != CacheMiss {
+				t.Errorf("got %v, %s, want a fresh read", value, info.Status)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package helpers
+
+import (
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	// load .env before any package reads its settings
+	_ "github.com/joho/godotenv/autoload"
+)
+
+// The edge is configured through environment variables (optionally from a .env
+// file). These helpers read them, falling back on a default when a variable is
+// unset or can't be parsed.
+
+var nonAlphanumeric = regexp.MustCompile("[^A-Z0-9]+")
+
+// EnvKey returns the variable of a setting for something with a name, eg.
+// EnvKey("BREAKER", "tracking-service", "OPEN_FOR") is
+// BREAKER_TRACKING_SERVICE_OPEN_FOR. The setting is left out when empty.
+func EnvKey(prefix, name, setting string) string {
+	key := prefix + "_" + nonAlphanumeric.ReplaceAllString(strings.ToUpper(name), "_")
+	if setting != "" {
+		key += "_" + setting
+	}
+	return key
+}
+
+func GetEnvString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func GetEnvInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, v, err)
+		return def
+	}
+	return i
+}
+
+func GetEnvFloat(key string, def float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, v, err)
+		return def
+	}
+	return f
+}
+
+func GetEnvBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, v, err)
+		return def
+	}
+	return b
+}
+
+// GetEnvDuration reads a duration like "1500ms" or "2m"
+func GetEnvDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, v, err)
+		return def
+	}
+	return d
+}
+
+// GetEnvList reads a comma separated list, leaving out empty entries
+func GetEnvList(key string, def []string) []string {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	var ret []string
+	for _, e := range strings.Split(v, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
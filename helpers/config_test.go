@@ -0,0 +1,21 @@
+package helpers
+
+import "testing"
+
+func TestEnvKey(t *testing.T) {
+	tests := []struct {
+		prefix, name, setting string
+		want                  string
+	}{
+		{"BREAKER", "tracking-service", "OPEN_FOR", "BREAKER_TRACKING_SERVICE_OPEN_FOR"},
+		{"BREAKER", "AuthService/Login", "SLOW_CALL", "BREAKER_AUTHSERVICE_LOGIN_SLOW_CALL"},
+		{"RETRY", "ProfileService/GetProfile", "ATTEMPTS", "RETRY_PROFILESERVICE_GETPROFILE_ATTEMPTS"},
+		{"ACTIVATION", "Some Org", "SUCCESS_URL", "ACTIVATION_SOME_ORG_SUCCESS_URL"},
+		{"SECURITY_HEADER", "X-Frame-Options", "", "SECURITY_HEADER_X_FRAME_OPTIONS"},
+	}
+	for _, tt := range tests {
+		if got := EnvKey(tt.prefix, tt.name, tt.setting); got != tt.want {
+			t.Errorf("EnvKey(%q, %q, %q) = %s, want %s", tt.prefix, tt.name, tt.setting, got, tt.want)
+		}
+	}
+}
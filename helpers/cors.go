@@ -0,0 +1,157 @@
+package helpers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/rs/cors"
+)
+
+// Which sites may call the API from a browser is configured per environment.
+// CORS_ALLOWED_ORIGINS lists the origins, either exact
+// (https://app.acubed.be), with wildcards (https://*.acubed.be) or * for any.
+// Nothing is allowed by default. CORS_ALLOWED_METHODS, CORS_ALLOWED_HEADERS,
+// CORS_EXPOSED_HEADERS, CORS_ALLOW_CREDENTIALS (for cookie sessions) and
+// CORS_MAX_AGE tune the rest of the policy.
+//
+// Routes can get a policy of their own: CORS_ROUTES maps path prefixes to a
+// policy name (eg. "/v1/tracking/capture=cameras"), whose settings are read
+// from CORS_<NAME>_<SETTING> and default to the ones above.
+
+var defaultExposedHeaders = []string{
+	"X-Request-ID", "X-Cache", "X-Stale", "Age", "Warning", "Retry-After", "Idempotent-Replayed",
+}
+
+type corsPolicy struct {
+	name    string
+	origins []string
+	cors    *cors.Cors
+}
+
+func loadCorsPolicy(name string) *corsPolicy {
+	get := func(setting string) string {
+		if name == "" {
+			return "CORS_" + setting
+		}
+		return EnvKey("CORS", name, setting)
+	}
+	getList := func(setting string, def []string) []string {
+		return GetEnvList(get(setting), GetEnvList("CORS_"+setting, def))
+	}
+
+	p := &corsPolicy{name: name, origins: getList("ALLOWED_ORIGINS", nil)}
+	options := cors.Options{
+		AllowedMethods:   getList("ALLOWED_METHODS", []string{"GET", "POST", "PUT", "PATCH", "DELETE"}),
+		AllowedHeaders:   getList("ALLOWED_HEADERS", []string{"Authorization", "Content-Type", "Idempotency-Key", "X-Csrf-Token", "X-Request-ID"}),
+		ExposedHeaders:   getList("EXPOSED_HEADERS", defaultExposedHeaders),
+		AllowCredentials: GetEnvBool(get("ALLOW_CREDENTIALS"), GetEnvBool("CORS_ALLOW_CREDENTIALS", false)),
+		MaxAge:           GetEnvInt(get("MAX_AGE"), GetEnvInt("CORS_MAX_AGE", 600)),
+		Debug:            GetEnvBool("CORS_DEBUG", false),
+	}
+
+	if p.allowsAnyOrigin() {
+		// answered with a literal *, which browsers never combine with credentials
+		if options.AllowCredentials {
+			log.Printf("CORS policy %q allows any origin, credentials won't be sent", name)
+		}
+		options.AllowedOrigins = []string{"*"}
+	} else {
+		options.AllowOriginFunc = p.isOriginAllowed
+	}
+
+	p.cors = cors.New(options)
+	return p
+}
+
+func (p *corsPolicy) allowsAnyOrigin() bool {
+	for _, o := range p.origins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *corsPolicy) isOriginAllowed(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, o := range p.origins {
+		o = strings.ToLower(o)
+		if o == origin {
+			return true
+		}
+		// path.Match's * doesn't cross a /, so a wildcard can't swallow the scheme
+		if strings.Contains(o, "*") {
+			if ok, _ := path.Match(o, origin); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Cors applies the CORS policy of the route to the request
+func Cors(next http.Handler) http.Handler {
+	policies := map[string]*corsPolicy{"": loadCorsPolicy("")}
+	routes := map[string]string{}
+	for _, route := range GetEnvList("CORS_ROUTES", nil) {
+		parts := strings.SplitN(route, "=", 2)
+		if len(parts) != 2 {
+			log.Printf("Ignoring invalid CORS route %q", route)
+			continue
+		}
+		routes[parts[0]] = parts[1]
+		if _, ok := policies[parts[1]]; !ok {
+			policies[parts[1]] = loadCorsPolicy(parts[1])
+		}
+	}
+
+	handlers := map[string]http.Handler{}
+	for name, p := range policies {
+		handlers[name] = p.cors.Handler(next)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := ""
+		longest := -1
+		for prefix, policy := range routes {
+			if strings.HasPrefix(r.URL.Path, prefix) && len(prefix) > longest {
+				name, longest = policy, len(prefix)
+			}
+		}
+
+		handlers[name].ServeHTTP(w, r)
+
+		if isPreflight(r) && w.Header().Get("Access-Control-Allow-Origin") == "" {
+			logRejectedPreflight(r, policies[name])
+		}
+	})
+}
+
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// logRejectedPreflight logs a structured event for a preflight the policy refused
+func logRejectedPreflight(r *http.Request, p *corsPolicy) {
+	origin := r.Header.Get("Origin")
+	reason := "method or headers not allowed"
+	if origin == "" {
+		reason = "no origin"
+	} else if !p.allowsAnyOrigin() && !p.isOriginAllowed(origin) {
+		reason = "origin not allowed"
+	}
+
+	event, _ := json.Marshal(map[string]string{
+		"event":   "cors.preflight_rejected",
+		"policy":  p.name,
+		"reason":  reason,
+		"origin":  origin,
+		"path":    r.URL.Path,
+		"method":  r.Header.Get("Access-Control-Request-Method"),
+		"headers": r.Header.Get("Access-Control-Request-Headers"),
+	})
+	log.Printf("%s", event)
+}
@@ -0,0 +1,276 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/balancer/roundrobin"
+	"google.golang.org/grpc/resolver"
+)
+
+// Every upstream is reached through one long lived connection, spread over all
+// of its endpoints instead of sticking to whichever pod a ClusterIP picked.
+// UPSTREAM_<NAME>_DISCOVERY decides how the endpoints are found:
+//  - dns (default): the A/AAAA records of the host
+//  - srv: the SRV records of UPSTREAM_<NAME>_SRV, or _grpc._tcp.<host>
+//  - static: the host:port list in UPSTREAM_<NAME>_ADDRESSES, eg. to run
+//    against several local servers
+// Endpoints are looked up again every UPSTREAM_RESOLVE_INTERVAL and whenever a
+// connection fails. UPSTREAM_<NAME>_BALANCER picks round_robin (default),
+// least_request or pick_first. NAME is the host up to the first dot, eg.
+// UPSTREAM_TRACKING_SERVICE_DISCOVERY.
+
+const (
+	upstreamScheme       = "edge"
+	leastRequestBalancer = "least_request"
+	minResolveInterval   = time.Second
+)
+
+type upstreamConfig struct {
+	Discovery string
+	Addresses []string
+	Srv       string
+	Balancer  string
+	Interval  time.Duration
+}
+
+func loadUpstreamConfig(name string) upstreamConfig {
+	get := func(setting string) string {
+		return EnvKey("UPSTREAM", name, setting)
+	}
+	return upstreamConfig{
+		Discovery: GetEnvString(get("DISCOVERY"), "dns"),
+		Addresses: GetEnvList(get("ADDRESSES"), nil),
+		Srv:       GetEnvString(get("SRV"), ""),
+		Balancer:  GetEnvString(get("BALANCER"), roundrobin.Name),
+		Interval:  GetEnvDuration(get("RESOLVE_INTERVAL"), GetEnvDuration("UPSTREAM_RESOLVE_INTERVAL", 30*time.Second)),
+	}
+}
+
+// serviceConfig is the gRPC service config selecting the balancer of the upstream
+func (c upstreamConfig) serviceConfig() string {
+	return fmt.Sprintf(`{"loadBalancingPolicy":%q}`, c.Balancer)
+}
+
+func init() {
+	resolver.Register(upstreamResolverBuilder{})
+	balancer.Register(leastRequestBuilder{})
+}
+
+type upstreamResolverBuilder struct{}
+
+func (upstreamResolverBuilder) Scheme() string {
+	return upstreamScheme
+}
+
+func (upstreamResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	host, port, err := net.SplitHostPort(target.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &upstreamResolver{
+		cc:         cc,
+		host:       host,
+		port:       port,
+		config:     loadUpstreamConfig(upstreamName(target.Endpoint)),
+		resolveNow: make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	if r.config.Discovery == "static" && len(r.config.Addresses) == 0 {
+		return nil, fmt.Errorf("static discovery of %s without addresses", target.Endpoint)
+	}
+	go r.watch()
+	return r, nil
+}
+
+type upstreamResolver struct {
+	cc         resolver.ClientConn
+	host, port string
+	config     upstreamConfig
+	resolveNow chan struct{}
+	done       chan struct{}
+}
+
+func (r *upstreamResolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.resolveNow <- struct{}{}:
+	default:
+	}
+}
+
+func (r *upstreamResolver) Close() {
+	close(r.done)
+}
+
+func (r *upstreamResolver) watch() {
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+
+	var last []string
+	for {
+		addresses, err := r.resolve()
+		if err != nil {
+			// keep using the endpoints we know of
+			log.Printf("Could not resolve %s: %v", r.host, err)
+			r.cc.ReportError(err)
+		} else if !equalStrings(addresses, last) {
+			log.Printf("Upstream %s resolved to %v", r.host, addresses)
+			state := resolver.State{Addresses: make([]resolver.Address, len(addresses))}
+			for i, a := range addresses {
+				state.Addresses[i] = resolver.Address{Addr: a, ServerName: r.host}
+			}
+			r.cc.UpdateState(state)
+			last = addresses
+		}
+
+		// connection failures ask for a lot of lookups, don't hammer the DNS
+		select {
+		case <-r.done:
+			return
+		case <-time.After(minResolveInterval):
+		}
+
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		case <-r.resolveNow:
+		}
+	}
+}
+
+// resolve returns the sorted endpoints of the upstream
+func (r *upstreamResolver) resolve() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var addresses []string
+	switch r.config.Discovery {
+	case "static":
+		addresses = append(addresses, r.config.Addresses...)
+	case "srv":
+		name := r.config.Srv
+		if name == "" {
+			name = "_grpc._tcp." + r.host
+		}
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range records {
+			addresses = append(addresses, net.JoinHostPort(strings.TrimSuffix(s.Target, "."), fmt.Sprint(s.Port)))
+		}
+	case "dns":
+		if net.ParseIP(r.host) != nil {
+			return []string{net.JoinHostPort(r.host, r.port)}, nil
+		}
+		hosts, err := net.DefaultResolver.LookupHost(ctx, r.host)
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range hosts {
+			addresses = append(addresses, net.JoinHostPort(h, r.port))
+		}
+	default:
+		return nil, fmt.Errorf("unknown discovery %q", r.config.Discovery)
+	}
+
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no endpoints found for %s", r.host)
+	}
+	sort.Strings(addresses)
+	return addresses, nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// leastRequestBuilder gives every connection its own picker builder, so the
+// calls in flight are counted per upstream
+type leastRequestBuilder struct{}
+
+func (leastRequestBuilder) Name() string {
+	return leastRequestBalancer
+}
+
+func (leastRequestBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	pickerBuilder := &leastRequestPickerBuilder{inFlight: map[balancer.SubConn]*int64{}}
+	return base.NewBalancerBuilderV2(leastRequestBalancer, pickerBuilder, base.Config{HealthCheck: true}).Build(cc, opts)
+}
+
+// leastRequestPickerBuilder sends calls to the endpoint with the fewest calls
+// in flight, out of two picked at random
+type leastRequestPickerBuilder struct {
+	// kept between pickers, only used from Build which the balancer doesn't call concurrently
+	inFlight map[balancer.SubConn]*int64
+}
+
+func (b *leastRequestPickerBuilder) Build(info base.PickerBuildInfo) balancer.V2Picker {
+	// forget endpoints that went away, calls still in flight on them hold on to their own count
+	for sc := range b.inFlight {
+		if _, ok := info.ReadySCs[sc]; !ok {
+			delete(b.inFlight, sc)
+		}
+	}
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPickerV2(balancer.ErrNoSubConnAvailable)
+	}
+
+	p := &leastRequestPicker{}
+	for sc := range info.ReadySCs {
+		count, ok := b.inFlight[sc]
+		if !ok {
+			count = new(int64)
+			b.inFlight[sc] = count
+		}
+		p.subConns = append(p.subConns, sc)
+		p.inFlight = append(p.inFlight, count)
+	}
+	return p
+}
+
+type leastRequestPicker struct {
+	subConns []balancer.SubConn
+	inFlight []*int64
+}
+
+func (p *leastRequestPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	i := rand.Intn(len(p.subConns))
+	if len(p.subConns) > 1 {
+		j := rand.Intn(len(p.subConns) - 1)
+		if j >= i {
+			j++
+		}
+		if atomic.LoadInt64(p.inFlight[j]) < atomic.LoadInt64(p.inFlight[i]) {
+			i = j
+		}
+	}
+
+	count := p.inFlight[i]
+	atomic.AddInt64(count, 1)
+	return balancer.PickResult{
+		SubConn: p.subConns[i],
+		Done: func(balancer.DoneInfo) {
+			atomic.AddInt64(count, -1)
+		},
+	}, nil
+}
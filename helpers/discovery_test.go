@@ -0,0 +1,214 @@
+package helpers
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/resolver"
+)
+
+// testUpstream is an in-process gRPC server that counts the calls it answers
+type testUpstream struct {
+	address string
+	server  *grpc.Server
+
+	mu    sync.Mutex
+	calls int
+	block chan struct{} // when set, calls wait for it to be closed
+}
+
+func startTestUpstream(t *testing.T) *testUpstream {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &testUpstream{address: lis.Addr().String()}
+	u.server = grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		u.mu.Lock()
+		u.calls++
+		block := u.block
+		u.mu.Unlock()
+		if block != nil {
+			<-block
+		}
+		return handler(ctx, req)
+	}))
+	healthpb.RegisterHealthServer(u.server, health.NewServer())
+	go func() { _ = u.server.Serve(lis) }()
+	return u
+}
+
+func (u *testUpstream) callCount() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.calls
+}
+
+// dialTestUpstreams connects to the servers through the edge resolver, as
+// statically discovered endpoints of the upstream with the name
+func dialTestUpstreams(t *testing.T, name, balancerName string, upstreams ...*testUpstream) *grpc.ClientConn {
+	var addresses []string
+	for _, u := range upstreams {
+		addresses = append(addresses, u.address)
+	}
+	prefix := "UPSTREAM_" + strings.ToUpper(strings.Replace(name, "-", "_", -1)) + "_"
+	_ = os.Setenv(prefix+"DISCOVERY", "static")
+	_ = os.Setenv(prefix+"ADDRESSES", strings.Join(addresses, ","))
+	defer os.Unsetenv(prefix + "DISCOVERY")
+	defer os.Unsetenv(prefix + "ADDRESSES")
+
+	config := upstreamConfig{Balancer: balancerName}
+	conn, err := grpc.Dial(upstreamScheme+":///"+name+":50551", grpc.WithInsecure(),
+		grpc.WithDefaultServiceConfig(config.serviceConfig()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func checkHealth(conn *grpc.ClientConn) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}, grpc.WaitForReady(true))
+	return err
+}
+
+// waitForEndpoints makes calls until every upstream answered one, so all
+// endpoints are resolved and connected
+func waitForEndpoints(t *testing.T, conn *grpc.ClientConn, upstreams ...*testUpstream) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if err := checkHealth(conn); err != nil {
+			t.Fatal(err)
+		}
+		all := true
+		for _, u := range upstreams {
+			all = all && u.callCount() > 0
+		}
+		if all {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("not every endpoint was reached")
+		}
+	}
+}
+
+func TestStaticDiscoveryRoundRobin(t *testing.T) {
+	upstreams := []*testUpstream{startTestUpstream(t), startTestUpstream(t), startTestUpstream(t)}
+	for _, u := range upstreams {
+		defer u.server.Stop()
+	}
+	conn := dialTestUpstreams(t, "round-robin-service", "round_robin", upstreams...)
+	defer conn.Close()
+	waitForEndpoints(t, conn, upstreams...)
+
+	before := make([]int, len(upstreams))
+	for i, u := range upstreams {
+		before[i] = u.callCount()
+	}
+	for i := 0; i < 30; i++ {
+		if err := checkHealth(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, u := range upstreams {
+		if calls := u.callCount() - before[i]; calls != 10 {
+			t.Errorf("upstream %d answered %d of 30 calls, want 10", i, calls)
+		}
+	}
+}
+
+func TestStaticDiscoveryLeastRequest(t *testing.T) {
+	slow, fast := startTestUpstream(t), startTestUpstream(t)
+	defer slow.server.Stop()
+	defer fast.server.Stop()
+	conn := dialTestUpstreams(t, "least-request-service", leastRequestBalancer, slow, fast)
+	defer conn.Close()
+	waitForEndpoints(t, conn, slow, fast)
+
+	release := make(chan struct{})
+	slow.mu.Lock()
+	slow.block = release
+	slowBefore := slow.calls
+	slow.mu.Unlock()
+
+	// once a call is stuck on the slow endpoint, every other call has to go to the fast one
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(release)
+	for i := 0; i < 20; i++ {
+		slowCalls := slow.callCount()
+		done := make(chan struct{})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done)
+			_ = checkHealth(conn)
+		}()
+		// wait until the call was answered or got stuck
+		deadline := time.Now().Add(5 * time.Second)
+	wait:
+		for slow.callCount() == slowCalls {
+			select {
+			case <-done:
+				break wait
+			case <-time.After(time.Millisecond):
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("call was not answered")
+			}
+		}
+	}
+
+	if calls := slow.callCount() - slowBefore; calls > 1 {
+		t.Errorf("the busy endpoint got %d calls, want at most 1", calls)
+	}
+}
+
+type testSubConn struct {
+	name string
+}
+
+func (*testSubConn) UpdateAddresses([]resolver.Address) {}
+func (*testSubConn) Connect()                           {}
+
+func TestLeastRequestForgetsEndpoints(t *testing.T) {
+	a, b, c := &testSubConn{"a"}, &testSubConn{"b"}, &testSubConn{"c"}
+	builder := &leastRequestPickerBuilder{inFlight: map[balancer.SubConn]*int64{}}
+	ready := func(scs ...balancer.SubConn) base.PickerBuildInfo {
+		info := base.PickerBuildInfo{ReadySCs: map[balancer.SubConn]base.SubConnInfo{}}
+		for _, sc := range scs {
+			info.ReadySCs[sc] = base.SubConnInfo{}
+		}
+		return info
+	}
+
+	builder.Build(ready(a, b))
+	countA := builder.inFlight[a]
+	builder.Build(ready(a, c))
+	if _, ok := builder.inFlight[b]; ok {
+		t.Error("count of the removed endpoint was kept")
+	}
+	if builder.inFlight[a] != countA {
+		t.Error("count of a remaining endpoint was replaced")
+	}
+	if len(builder.inFlight) != 2 {
+		t.Errorf("counting %d endpoints, want 2", len(builder.inFlight))
+	}
+
+	builder.Build(ready())
+	if len(builder.inFlight) != 0 {
+		t.Errorf("counting %d endpoints without any ready, want 0", len(builder.inFlight))
+	}
+}
@@ -0,0 +1,271 @@
+package helpers
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Clients that retry a POST, PUT, PATCH or DELETE can send the same
+// Idempotency-Key header with every attempt. The first successful response to
+// a key is kept for IDEMPOTENCY_TTL and replayed to the retries, so the
+// request only takes effect once. Errors aren't kept, the request is handled
+// again when it's retried. Keys are scoped to the account of the client, and
+// reusing one for a different request is refused with a 422. Requests without
+// valid credentials are handled as if they had no key. At most
+// IDEMPOTENCY_MAX_KEYS responses are kept, the oldest go first.
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+const idempotencyKeyContextKey contextKey = "idempotencyKey"
+
+var (
+	errIdempotencyKeyReused = errors.New("idempotency key was already used for a different request")
+	errIdempotencyKeyLong   = errors.New("idempotency key is longer than 255 characters")
+)
+
+var (
+	idempotencyTtl     = GetEnvDuration("IDEMPOTENCY_TTL", 24*time.Hour)
+	idempotencyMaxKeys = GetEnvInt("IDEMPOTENCY_MAX_KEYS", 10000)
+)
+
+type idempotentResponse struct {
+	fingerprint string
+	done        chan struct{} // closed once the response below is known
+	status      int
+	header      http.Header
+	body        []byte
+	expires     time.Time
+	element     *list.Element // in idempotentResponses.order
+}
+
+var idempotentResponses = struct {
+	sync.Mutex
+	byKey     map[string]*idempotentResponse
+	order     *list.List // of scopes, oldest first
+	lastSweep time.Time
+}{
+	byKey: map[string]*idempotentResponse{},
+	order: list.New(),
+}
+
+// Idempotency replays the stored response to requests that repeat an Idempotency-Key
+func Idempotency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > 255 {
+			WriteErrorJsonStatus(w, r, http.StatusBadRequest, errIdempotencyKeyLong)
+			return
+		}
+		account, ok := idempotencyAccount(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			WriteErrorJson(w, r, err)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		scope := hashParts(key, account)
+		fingerprint := hashParts(r.Method, r.URL.Path, string(body))
+
+		stored, first := claimIdempotencyKey(scope, fingerprint)
+		if !first {
+			select {
+			case <-stored.done:
+			case <-r.Context().Done():
+				return
+			}
+			if stored.fingerprint != fingerprint {
+				WriteErrorJsonStatus(w, r, http.StatusUnprocessableEntity, errIdempotencyKeyReused)
+				return
+			}
+			log.Printf("Replaying response for idempotency key %s", key)
+			for k, v := range stored.header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.status)
+			_, _ = w.Write(stored.body)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		ctx := context.WithValue(r.Context(), idempotencyKeyContextKey, key)
+		defer func() {
+			if p := recover(); p != nil {
+				forgetIdempotencyKey(scope, stored)
+				panic(p)
+			}
+			// don't hold on to failures that a retry may fix
+			if !isSuccess(rec.status, rec.body.Bytes()) {
+				forgetIdempotencyKey(scope, stored)
+				return
+			}
+			stored.status = rec.status
+			stored.header = rec.Header().Clone()
+			// the body is kept as the handler wrote it, encoding it is up to the middleware again
+			stored.header.Del("Content-Encoding")
+			stored.header.Del("Content-Length")
+			stored.body = rec.body.Bytes()
+			close(stored.done)
+		}()
+		next.ServeHTTP(rec, r.WithContext(ctx))
+	})
+}
+
+// GetIdempotencyKey returns the Idempotency-Key of a request that passed
+// Idempotency, or an empty string. Pass it on to WithIdempotencyKey.
+func GetIdempotencyKey(r *http.Request) string {
+	key, _ := r.Context().Value(idempotencyKeyContextKey).(string)
+	return key
+}
+
+// idempotencyAccount returns whose request it is, keys are scoped to it so
+// clients can't see each other's responses. It is false for requests without
+// valid credentials. Camera credentials are only checked by the tracking
+// routes, so the camera key itself stands in for the account.
+var idempotencyAccount = func(r *http.Request) (string, bool) {
+	if token, err := GetJwtToken(r); err == nil {
+		accountUuid, err := GetAccountUuid(token)
+		if err != nil || accountUuid == "" {
+			return "", false
+		}
+		return "account:" + accountUuid, true
+	}
+	if key := r.Header.Get("X-Api-Key"); key != "" {
+		return "api-key:" + key, true
+	}
+	if key := r.Header.Get("X-Camera-Key"); key != "" {
+		return "camera-key:" + key, true
+	}
+	return "", false
+}
+
+func hashParts(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		_, _ = h.Write([]byte(p))
+		_, _ = h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// claimIdempotencyKey returns the response stored for the scope, and whether
+// this request is the first and should produce it
+func claimIdempotencyKey(scope, fingerprint string) (*idempotentResponse, bool) {
+	idempotentResponses.Lock()
+	defer idempotentResponses.Unlock()
+
+	now := time.Now()
+	if now.Sub(idempotentResponses.lastSweep) > time.Minute {
+		// all keys live equally long, so the expired ones are at the front
+		for e := idempotentResponses.order.Front(); e != nil; e = idempotentResponses.order.Front() {
+			if !now.After(idempotentResponses.byKey[e.Value.(string)].expires) {
+				break
+			}
+			dropIdempotentResponse(e.Value.(string))
+		}
+		idempotentResponses.lastSweep = now
+	}
+
+	if stored, ok := idempotentResponses.byKey[scope]; ok {
+		return stored, false
+	}
+	for idempotentResponses.order.Len() >= idempotencyMaxKeys && idempotentResponses.order.Len() > 0 {
+		dropIdempotentResponse(idempotentResponses.order.Front().Value.(string))
+	}
+	stored := &idempotentResponse{
+		fingerprint: fingerprint,
+		done:        make(chan struct{}),
+		expires:     now.Add(idempotencyTtl),
+		element:     idempotentResponses.order.PushBack(scope),
+	}
+	idempotentResponses.byKey[scope] = stored
+	return stored, true
+}
+
+// dropIdempotentResponse must be called with the lock held
+func dropIdempotentResponse(scope string) {
+	if stored, ok := idempotentResponses.byKey[scope]; ok {
+		idempotentResponses.order.Remove(stored.element)
+		delete(idempotentResponses.byKey, scope)
+	}
+}
+
+// forgetIdempotencyKey drops the response so the next request with the key is handled again
+func forgetIdempotencyKey(scope string, stored *idempotentResponse) {
+	idempotentResponses.Lock()
+	if idempotentResponses.byKey[scope] == stored {
+		dropIdempotentResponse(scope)
+	}
+	idempotentResponses.Unlock()
+
+	// requests waiting on it get a 503 and can retry
+	stored.status = http.StatusServiceUnavailable
+	stored.header = http.Header{"Retry-After": []string{"1"}}
+	close(stored.done)
+}
+
+// isSuccess tells whether a response is worth replaying. WriteErrorJson
+// answers most errors with a 200, so the body is checked for an error too.
+func isSuccess(status int, body []byte) bool {
+	if status < 200 || status >= 300 {
+		return false
+	}
+	var resp struct {
+		Error *json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		// not a JSON object, so not written by WriteErrorJson
+		return true
+	}
+	return resp.Error == nil
+}
+
+// responseRecorder passes the response on while keeping a copy
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// Flush lets handlers that stream their response flush through the recorder
+func (rec *responseRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		rec.wroteHeader = true
+		f.Flush()
+	}
+}
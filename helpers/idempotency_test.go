@@ -0,0 +1,233 @@
+package helpers
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// idempotentHandler counts its calls and answers with the response of the call
+func idempotentHandler(calls *int32, respond func(w http.ResponseWriter, r *http.Request, n int32)) http.Handler {
+	return Idempotency(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respond(w, r, atomic.AddInt32(calls, 1))
+	}))
+}
+
+// forgetIdempotentResponses empties the store, and has tokens "a1" and "a2"
+// belong to account a and every other token to an account of its own until
+// the returned func is called
+func forgetIdempotentResponses() func() {
+	idempotentResponses.Lock()
+	idempotentResponses.byKey = map[string]*idempotentResponse{}
+	idempotentResponses.order = list.New()
+	idempotentResponses.Unlock()
+
+	previous := idempotencyAccount
+	idempotencyAccount = func(r *http.Request) (string, bool) {
+		token, err := GetJwtToken(r)
+		if err != nil {
+			return "", false
+		}
+		return strings.TrimRight(token, "0123456789"), true
+	}
+	return func() { idempotencyAccount = previous }
+}
+
+func idempotentRequest(h http.Handler, key, auth, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/things", strings.NewReader(body))
+	r.Header.Set(idempotencyKeyHeader, key)
+	if auth != "" {
+		r.Header.Set("Authorization", auth)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestIdempotencyStoresSuccesses(t *testing.T) {
+	tests := []struct {
+		name       string
+		respond    func(w http.ResponseWriter, r *http.Request, n int32)
+		wantReplay bool
+		wantSecond string
+	}{
+		{
+			name: "success",
+			respond: func(w http.ResponseWriter, r *http.Request, n int32) {
+				WriteSuccessJson(w, r, n)
+			},
+			wantReplay: true,
+			wantSecond: `{"data":1}`,
+		},
+		{
+			name: "created without a body",
+			respond: func(w http.ResponseWriter, r *http.Request, n int32) {
+				w.WriteHeader(http.StatusCreated)
+			},
+			wantReplay: true,
+		},
+		{
+			name: "error with a 200",
+			respond: func(w http.ResponseWriter, r *http.Request, n int32) {
+				WriteErrorJson(w, r, fmt.Errorf("attempt %d failed", n))
+			},
+			wantSecond: `{"error":{"message":"attempt 2 failed"}}`,
+		},
+		{
+			name: "client error",
+			respond: func(w http.ResponseWriter, r *http.Request, n int32) {
+				WriteErrorJsonStatus(w, r, http.StatusConflict, errors.New("conflict"))
+			},
+		},
+		{
+			name: "server error",
+			respond: func(w http.ResponseWriter, r *http.Request, n int32) {
+				w.WriteHeader(http.StatusBadGateway)
+			},
+		},
+		{
+			name: "circuit open",
+			respond: func(w http.ResponseWriter, r *http.Request, n int32) {
+				WriteErrorJson(w, r, ErrCircuitOpen)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			h := idempotentHandler(&calls, tt.respond)
+			defer forgetIdempotentResponses()()
+
+			first := idempotentRequest(h, "key", "Bearer a1", "{}")
+			second := idempotentRequest(h, "key", "Bearer a1", "{}")
+
+			replayed := second.Header().Get("Idempotent-Replayed") == "true"
+			if replayed != tt.wantReplay {
+				t.Errorf("replayed = %v, want %v", replayed, tt.wantReplay)
+			}
+			wantCalls := int32(2)
+			if tt.wantReplay {
+				wantCalls = 1
+			}
+			if calls != wantCalls {
+				t.Errorf("handler called %d times, want %d", calls, wantCalls)
+			}
+			if second.Code != first.Code {
+				t.Errorf("status = %d, want %d", second.Code, first.Code)
+			}
+			if tt.wantSecond != "" && strings.TrimSpace(second.Body.String()) != tt.wantSecond {
+				t.Errorf("body = %s, want %s", second.Body.String(), tt.wantSecond)
+			}
+		})
+	}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	tests := []struct {
+		name       string
+		key2       string
+		auth2      string
+		body2      string
+		wantStatus int
+		wantCalls  int32
+	}{
+		{"same request", "key", "Bearer a1", "{}", http.StatusOK, 1},
+		{"other body", "key", "Bearer a1", `{"a":1}`, http.StatusUnprocessableEntity, 1},
+		{"other token of the account", "key", "Bearer a2", "{}", http.StatusOK, 1},
+		{"other account", "key", "Bearer b", "{}", http.StatusOK, 2},
+		{"unauthenticated", "key", "", "{}", http.StatusOK, 2},
+		{"other key", "other", "Bearer a1", "{}", http.StatusOK, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			h := idempotentHandler(&calls, func(w http.ResponseWriter, r *http.Request, n int32) {
+				WriteSuccessJson(w, r, n)
+			})
+			defer forgetIdempotentResponses()()
+
+			idempotentRequest(h, "key", "Bearer a1", "{}")
+			w := idempotentRequest(h, tt.key2, tt.auth2, tt.body2)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("handler called %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestIdempotencySkips(t *testing.T) {
+	var calls int32
+	h := idempotentHandler(&calls, func(w http.ResponseWriter, r *http.Request, n int32) {
+		WriteSuccessJson(w, r, n)
+	})
+	defer forgetIdempotentResponses()()
+
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/things", nil)
+		r.Header.Set(idempotencyKeyHeader, "key")
+		r.Header.Set("Authorization", "Bearer a1")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	idempotentRequest(h, "", "Bearer a1", "{}")
+	for i := 0; i < 2; i++ {
+		idempotentRequest(h, "key", "", "{}")
+	}
+	if calls != 5 {
+		t.Errorf("handler called %d times, want 5", calls)
+	}
+	if n := len(idempotentResponses.byKey); n != 0 {
+		t.Errorf("%d responses were kept", n)
+	}
+
+	if w := idempotentRequest(h, strings.Repeat("k", 256), "Bearer a1", "{}"); w.Code != http.StatusBadRequest {
+		t.Errorf("long key: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestIdempotencyFlushes(t *testing.T) {
+	h := Idempotency(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, ok := w.(http.Flusher)
+		if !ok {
+			t.Fatal("the recorder is not a http.Flusher")
+		}
+		_, _ = w.Write([]byte("part"))
+		f.Flush()
+	}))
+
+	defer forgetIdempotentResponses()()
+	w := idempotentRequest(h, "key", "Bearer a1", "{}")
+	if !w.Flushed {
+		t.Error("the response was not flushed")
+	}
+}
+
+func TestIdempotencyMaxKeys(t *testing.T) {
+	defer forgetIdempotentResponses()()
+	previous := idempotencyMaxKeys
+	idempotencyMaxKeys = 2
+	defer func() { idempotencyMaxKeys = previous }()
+
+	var calls int32
+	h := idempotentHandler(&calls, func(w http.ResponseWriter, r *http.Request, n int32) {
+		WriteSuccessJson(w, r, n)
+	})
+	for _, key := range []string{"first", "second", "third", "second", "third", "first"} {
+		idempotentRequest(h, key, "Bearer a1", "{}")
+	}
+
+	// the first key was dropped for the third, and its retry pushed out the second
+	if calls != 4 {
+		t.Errorf("handler called %d times, want 4", calls)
+	}
+	if n := len(idempotentResponses.byKey); n != 2 || idempotentResponses.order.Len() != 2 {
+		t.Errorf("%d responses kept in an order of %d, want 2", n, idempotentResponses.order.Len())
+	}
+}
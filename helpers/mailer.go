@@ -0,0 +1,178 @@
+package helpers
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mail the edge sends to users (email verification) goes
+// through the mailer named in MAILER:
+//  - smtp: sends it through MAILER_SMTP_ADDR (host:port), logging in with
+//    MAILER_SMTP_USER and MAILER_SMTP_PASSWORD when set
+//  - stdout: prints the mail, for local development
+//  - file: writes every mail to a file in MAILER_DIR, for local development
+// The mails carry reset and verification tokens, so stdout and file, which put
+// them in logs or on disk, also need MAILER_DEVELOPMENT=true. The edge doesn't
+// start without a usable mailer. Other mailers can be added with
+// RegisterMailer. Mail is sent from MAIL_FROM.
+
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(m Mail) error
+}
+
+var mailers = struct {
+	sync.Mutex
+	factories map[string]func() (Mailer, error)
+	current   Mailer
+}{
+	factories: map[string]func() (Mailer, error){
+		"stdout": func() (Mailer, error) { return stdoutMailer{}, nil },
+		"file":   newFileMailer,
+		"smtp":   newSmtpMailer,
+	},
+}
+
+// developmentMailers keep the mails where others can read them
+var developmentMailers = map[string]bool{"stdout": true, "file": true}
+
+// RegisterMailer makes a mailer available under the name for MAILER
+func RegisterMailer(name string, factory func() (Mailer, error)) {
+	mailers.Lock()
+	defer mailers.Unlock()
+	mailers.factories[name] = factory
+}
+
+func currentMailer() (Mailer, error) {
+	mailers.Lock()
+	defer mailers.Unlock()
+	if mailers.current != nil {
+		return mailers.current, nil
+	}
+
+	name := GetEnvString("MAILER", "")
+	if name == "" {
+		return nil, errors.New("no mailer configured in MAILER")
+	}
+	factory, ok := mailers.factories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown mailer %s", name)
+	}
+	if developmentMailers[name] && !GetEnvBool("MAILER_DEVELOPMENT", false) {
+		return nil, fmt.Errorf("mailer %s is only for development, set MAILER_DEVELOPMENT=true to use it", name)
+	}
+	m, err := factory()
+	if err != nil {
+		return nil, err
+	}
+	mailers.current = m
+	return m, nil
+}
+
+// CheckMailer returns an error when mail can't be sent with the configured mailer
+func CheckMailer() error {
+	_, err := currentMailer()
+	return err
+}
+
+// SendMail sends the mail with the configured mailer
+func SendMail(m Mail) error {
+	if !isHeaderSafe(m.To) || !isHeaderSafe(m.Subject) {
+		return errors.New("mail recipient and subject can't span lines")
+	}
+	mailer, err := currentMailer()
+	if err != nil {
+		return err
+	}
+	if err := mailer.Send(m); err != nil {
+		return fmt.Errorf("could not send mail to %s: %w", m.To, err)
+	}
+	log.Printf("Sent mail %q to %s", m.Subject, m.To)
+	return nil
+}
+
+func (m Mail) format() string {
+	headers := []string{
+		"From: " + mailFrom(),
+		"To: " + m.To,
+		"Subject: " + m.Subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+	}
+	return strings.Join(headers, "\r\n") + "\r\n\r\n" + strings.ReplaceAll(m.Body, "\n", "\r\n")
+}
+
+func mailFrom() string {
+	return GetEnvString("MAIL_FROM", "aCubed <no-reply@acubed.app>")
+}
+
+// isHeaderSafe is false for values that could add headers of their own
+func isHeaderSafe(v string) bool {
+	return !strings.ContainsAny(v, "\r\n")
+}
+
+type stdoutMailer struct{}
+
+func (stdoutMailer) Send(m Mail) error {
+	_, err := fmt.Fprintf(os.Stdout, "----- mail -----\n%s\n----------------\n", m.format())
+	return err
+}
+
+type fileMailer struct {
+	dir string
+}
+
+func newFileMailer() (Mailer, error) {
+	dir := GetEnvString("MAILER_DIR", "mail")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return fileMailer{dir: dir}, nil
+}
+
+func (f fileMailer) Send(m Mail) error {
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405.000"), NewUuid())
+	return ioutil.WriteFile(filepath.Join(f.dir, name), []byte(m.format()), 0600)
+}
+
+type smtpMailer struct {
+	addr string
+	auth smtp.Auth
+}
+
+func newSmtpMailer() (Mailer, error) {
+	addr := GetEnvString("MAILER_SMTP_ADDR", "")
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MAILER_SMTP_ADDR: %w", err)
+	}
+
+	m := smtpMailer{addr: addr}
+	if user := GetEnvString("MAILER_SMTP_USER", ""); user != "" {
+		m.auth = smtp.PlainAuth("", user, GetEnvString("MAILER_SMTP_PASSWORD", ""), host)
+	}
+	return m, nil
+}
+
+func (s smtpMailer) Send(m Mail) error {
+	from := mailFrom()
+	if i := strings.LastIndex(from, "<"); i != -1 {
+		from = strings.TrimSuffix(from[i+1:], ">")
+	}
+	return smtp.SendMail(s.addr, s.auth, from, []string{m.To}, []byte(m.format()))
+}
@@ -0,0 +1,55 @@
+package helpers
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCheckMailer(t *testing.T) {
+	tests := []struct {
+		name        string
+		mailer      string
+		development string
+		smtpAddr    string
+		wantErr     bool
+	}{
+		{"none", "", "", "", true},
+		{"unknown", "pigeon", "", "", true},
+		{"stdout", "stdout", "", "", true},
+		{"stdout in development", "stdout", "true", "", false},
+		{"file", "file", "", "", true},
+		{"smtp", "smtp", "", "smtp.example.com:587", false},
+		{"smtp without an address", "smtp", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{
+				"MAILER":             tt.mailer,
+				"MAILER_DEVELOPMENT": tt.development,
+				"MAILER_SMTP_ADDR":   tt.smtpAddr,
+			}
+			for k, v := range env {
+				_ = os.Setenv(k, v)
+				defer os.Unsetenv(k)
+			}
+			mailers.Lock()
+			mailers.current = nil
+			mailers.Unlock()
+
+			if err := CheckMailer(); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSendMailRefusesHeaders(t *testing.T) {
+	for _, m := range []Mail{
+		{To: "someone@example.com\r\nBcc: other@example.com", Subject: "Hi"},
+		{To: "someone@example.com", Subject: "Hi\nBcc: other@example.com"},
+	} {
+		if err := SendMail(m); err == nil {
+			t.Errorf("mail %q to %q was sent", m.Subject, m.To)
+		}
+	}
+}
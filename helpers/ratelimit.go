@@ -0,0 +1,85 @@
+package helpers
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter allows a key at most Limit times per Window. Both can be set
+// through RATE_LIMIT_<NAME>_LIMIT and RATE_LIMIT_<NAME>_WINDOW. Hits are only
+// counted in memory, so every replica of the edge limits on its own.
+type RateLimiter struct {
+	Limit  int
+	Window time.Duration
+
+	mu        sync.Mutex
+	hits      map[string][]time.Time
+	lastSweep time.Time
+}
+
+func NewRateLimiter(name string, limit int, window time.Duration) *RateLimiter {
+	get := func(setting string) string {
+		return EnvKey("RATE_LIMIT", name, setting)
+	}
+	return &RateLimiter{
+		Limit:  GetEnvInt(get("LIMIT"), limit),
+		Window: GetEnvDuration(get("WINDOW"), window),
+		hits:   map[string][]time.Time{},
+	}
+}
+
+// Reserve counts a hit for the key when it's within the limit, and otherwise
+// returns how long until it is allowed again. Checking and counting happen at
+// once, so concurrent callers can't both take the last hit. Release gives the
+// hit back when the limited action didn't happen after all.
+func (l *RateLimiter) Reserve(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+	hits := l.recent(key, now)
+	if len(hits) >= l.Limit {
+		if len(hits) == 0 {
+			// a limit of 0 never allows the key
+			return false, l.Window
+		}
+		return false, hits[0].Add(l.Window).Sub(now)
+	}
+	l.hits[key] = append(hits, now)
+	return true, 0
+}
+
+// Release forgets the last hit reserved for the key
+func (l *RateLimiter) Release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if hits := l.hits[key]; len(hits) > 0 {
+		l.hits[key] = hits[:len(hits)-1]
+	}
+}
+
+// sweep forgets keys without recent hits, it must be called with the lock held
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) <= l.Window {
+		return
+	}
+	for k := range l.hits {
+		l.hits[k] = l.recent(k, now)
+		if len(l.hits[k]) == 0 {
+			delete(l.hits, k)
+		}
+	}
+	l.lastSweep = now
+}
+
+// recent returns the hits of the key within the window, oldest first
+func (l *RateLimiter) recent(key string, now time.Time) []time.Time {
+	hits := l.hits[key]
+	i := 0
+	for i < len(hits) && now.Sub(hits[i]) >= l.Window {
+		i++
+	}
+	return hits[i:]
+}
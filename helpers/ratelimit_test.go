@@ -0,0 +1,105 @@
+package helpers
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   int
+		hits    []time.Duration // how long ago each hit was recorded
+		want    bool
+		minWait time.Duration
+	}{
+		{"no hits", 2, nil, true, 0},
+		{"below the limit", 2, []time.Duration{10 * time.Second}, true, 0},
+		{"at the limit", 2, []time.Duration{30 * time.Second, 10 * time.Second}, false, 25 * time.Second},
+		{"old hits don't count", 2, []time.Duration{2 * time.Minute, 90 * time.Second, 10 * time.Second}, true, 0},
+		{"hit just outside the window", 1, []time.Duration{time.Minute}, true, 0},
+		{"no hits allowed", 0, nil, false, time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &RateLimiter{Limit: tt.limit, Window: time.Minute, hits: map[string][]time.Time{}, lastSweep: time.Now()}
+			now := time.Now()
+			for _, ago := range tt.hits {
+				l.hits["key"] = append(l.hits["key"], now.Add(-ago))
+			}
+
+			ok, wait := l.Reserve("key")
+			if ok != tt.want {
+				t.Errorf("allowed = %v, want %v", ok, tt.want)
+			}
+			if wait < tt.minWait || wait > l.Window {
+				t.Errorf("wait = %v, want between %v and %v", wait, tt.minWait, l.Window)
+			}
+			if ok, _ := l.Reserve("other"); ok != (tt.limit > 0) {
+				t.Errorf("other key allowed = %v", ok)
+			}
+		})
+	}
+}
+
+func TestRateLimiterRelease(t *testing.T) {
+	l := &RateLimiter{Limit: 2, Window: time.Minute, hits: map[string][]time.Time{}}
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Reserve("key"); !ok {
+			t.Fatalf("reservation %d was limited", i)
+		}
+	}
+	if ok, wait := l.Reserve("key"); ok || wait <= 0 {
+		t.Fatalf("allowed = %v, wait = %v after reaching the limit", ok, wait)
+	}
+
+	l.Release("key")
+	if ok, _ := l.Reserve("key"); !ok {
+		t.Error("released hit still counted")
+	}
+	if ok, _ := l.Reserve("key"); ok {
+		t.Error("reserved more hits than the limit")
+	}
+
+	l.Release("unknown")
+	if len(l.hits["unknown"]) != 0 {
+		t.Error("releasing a key without hits added some")
+	}
+}
+
+func TestRateLimiterReserveIsAtomic(t *testing.T) {
+	l := &RateLimiter{Limit: 3, Window: time.Minute, hits: map[string][]time.Time{}}
+
+	var wg sync.WaitGroup
+	var allowed int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, _ := l.Reserve("key"); ok {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != 3 {
+		t.Errorf("%d concurrent reservations allowed, want 3", allowed)
+	}
+}
+
+func TestRateLimiterSweeps(t *testing.T) {
+	l := &RateLimiter{Limit: 1, Window: time.Minute, hits: map[string][]time.Time{}}
+	l.hits["old"] = []time.Time{time.Now().Add(-time.Hour)}
+	l.Reserve("new")
+
+	if _, ok := l.hits["old"]; ok {
+		t.Error("key without recent hits was kept")
+	}
+	if len(l.hits["new"]) != 1 {
+		t.Errorf("new key has %d hits, want 1", len(l.hits["new"]))
+	}
+}
@@ -3,6 +3,7 @@ package helpers
 import (
 	"encoding/json"
 	"errors"
+	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/render"
 	"io/ioutil"
 	"log"
@@ -38,8 +39,25 @@ func WriteSuccessJson(w http.ResponseWriter, r *http.Request, v interface{}) {
 	render.JSON(w, r, resp)
 }
 
+// WriteSuccessJsonPage writes one page of a paginated response, next is the
+// cursor of the next page and is left out when this is the last one
+func WriteSuccessJsonPage(w http.ResponseWriter, r *http.Request, v interface{}, next string) {
+	log.Printf("Returning success page: %v", v)
+	var resp struct {
+		Value interface{} `json:"data"`
+		Next  string      `json:"next,omitempty"`
+	}
+	resp.Value = v
+	resp.Next = next
+	render.JSON(w, r, resp)
+}
+
 func WriteErrorJson(w http.ResponseWriter, r *http.Request, e error) {
 	log.Printf("Returning error: %v", e.Error())
+	if errors.Is(e, ErrCircuitOpen) {
+		w.Header().Set("Retry-After", "10")
+		render.Status(r, http.StatusServiceUnavailable)
+	}
 	var resp struct {
 		Error struct {
 			Message string `json:"message"`
@@ -49,9 +67,18 @@ func WriteErrorJson(w http.ResponseWriter, r *http.Request, e error) {
 	render.JSON(w, r, resp)
 }
 
+// WriteErrorJsonStatus is WriteErrorJson with a status code other than 200
+func WriteErrorJsonStatus(w http.ResponseWriter, r *http.Request, status int, e error) {
+	render.Status(r, status)
+	WriteErrorJson(w, r, e)
+}
+
 func GetJwtToken(r *http.Request) (string, error) {
 	header := r.Header.Get("Authorization")
 	if header == "" {
+		if token, ok := r.Context().Value(sessionTokenKey).(string); ok {
+			return token, nil
+		}
 		return "", errors.New("couldn't find authorization header")
 	}
 
@@ -61,3 +88,13 @@ func GetJwtToken(r *http.Request) (string, error) {
 
 	return header[7:], nil
 }
+
+// WriteRequestId sends the id middleware.RequestID gave the request back to the client
+func WriteRequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := middleware.GetReqID(r.Context()); id != "" {
+			w.Header().Set("X-Request-ID", id)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
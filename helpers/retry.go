@@ -0,0 +1,244 @@
+package helpers
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Upstream calls that fail with a transient error are retried with jittered
+// exponential backoff, but only when calling them twice is safe: the method is
+// in RETRY_IDEMPOTENT_METHODS, or the call carries an idempotency key (see
+// WithIdempotencyKey) which is forwarded so the upstream can deduplicate it.
+//
+// A call is attempted at most RETRY_ATTEMPTS times on RETRY_CODES, waiting
+// RETRY_BACKOFF doubling up to RETRY_MAX_BACKOFF between attempts, and is not
+// retried once RETRY_BUDGET has passed since the first attempt. Methods in
+// RETRY_HEDGE_METHODS send another attempt when there's no reply after
+// RETRY_HEDGE_DELAY and use whichever answers first. Every setting can be
+// overridden per method as RETRY_<METHOD>_<SETTING>, eg. RETRY_PROFILESERVICE_GETPROFILE_ATTEMPTS.
+
+const idempotencyKeyMetadata = "idempotency-key"
+
+type retryPolicy struct {
+	Attempts   int
+	Codes      map[codes.Code]bool
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Budget     time.Duration
+	Idempotent bool
+	HedgeDelay time.Duration // 0 when the method is not hedged
+}
+
+var defaultIdempotentMethods = []string{
+	"AuthService/GetUuidFromToken",
+	"AuthService/IsEmailRegistered",
+	"AuthService/GetInvitesByEmail",
+	"ProfileService/GetProfile",
+	"ProfileService/GetOrganizationProfile",
+	"ProfileService/GetEmails",
+	"TrackingService/GetAllObjects",
+	"TrackingService/GetObject",
+	"TrackingService/UpdatePositions",
+}
+
+var retryPolicies = struct {
+	sync.Mutex
+	idempotent map[string]bool
+	hedged     map[string]bool
+	byMethod   map[string]retryPolicy
+}{
+	idempotent: map[string]bool{},
+	hedged:     map[string]bool{},
+	byMethod:   map[string]retryPolicy{},
+}
+
+func init() {
+	for _, m := range GetEnvList("RETRY_IDEMPOTENT_METHODS", defaultIdempotentMethods) {
+		retryPolicies.idempotent[m] = true
+	}
+	for _, m := range GetEnvList("RETRY_HEDGE_METHODS", nil) {
+		retryPolicies.hedged[m] = true
+	}
+}
+
+// retryPolicyOf returns the policy of a method, loading it on first use
+func retryPolicyOf(method string) retryPolicy {
+	retryPolicies.Lock()
+	defer retryPolicies.Unlock()
+	if p, ok := retryPolicies.byMethod[method]; ok {
+		return p
+	}
+	p := loadRetryPolicy(method)
+	retryPolicies.byMethod[method] = p
+	return p
+}
+
+func loadRetryPolicy(method string) retryPolicy {
+	get := func(setting string) string {
+		return EnvKey("RETRY", method, setting)
+	}
+
+	defaultCodes := GetEnvList("RETRY_CODES", []string{"Unavailable"})
+	p := retryPolicy{
+		Attempts:   GetEnvInt(get("ATTEMPTS"), GetEnvInt("RETRY_ATTEMPTS", 3)),
+		Codes:      map[codes.Code]bool{},
+		Backoff:    GetEnvDuration(get("BACKOFF"), GetEnvDuration("RETRY_BACKOFF", 50*time.Millisecond)),
+		MaxBackoff: GetEnvDuration(get("MAX_BACKOFF"), GetEnvDuration("RETRY_MAX_BACKOFF", time.Second)),
+		Budget:     GetEnvDuration(get("BUDGET"), GetEnvDuration("RETRY_BUDGET", 2*time.Second)),
+		Idempotent: retryPolicies.idempotent[method],
+	}
+	for _, name := range GetEnvList(get("CODES"), defaultCodes) {
+		code, ok := codeNames[name]
+		if !ok {
+			log.Printf("Ignoring unknown retry code %s for %s", name, method)
+			continue
+		}
+		p.Codes[code] = true
+	}
+	if retryPolicies.hedged[method] {
+		p.HedgeDelay = GetEnvDuration(get("HEDGE_DELAY"), GetEnvDuration("RETRY_HEDGE_DELAY", 100*time.Millisecond))
+	}
+	return p
+}
+
+var codeNames = map[string]codes.Code{}
+
+func init() {
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		codeNames[c.String()] = c
+	}
+}
+
+type idempotencyKeyContext struct{}
+
+// WithIdempotencyKey marks the calls made with the context as safe to retry,
+// and passes the key on to the upstream so it can recognise repeated calls
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	if key == "" {
+		return ctx
+	}
+	ctx = context.WithValue(ctx, idempotencyKeyContext{}, key)
+	return metadata.AppendToOutgoingContext(ctx, idempotencyKeyMetadata, key)
+}
+
+func hasIdempotencyKey(ctx context.Context) bool {
+	key, _ := ctx.Value(idempotencyKeyContext{}).(string)
+	return key != ""
+}
+
+// retryable is true when another attempt may fix the error
+func (p retryPolicy) retryable(err error) bool {
+	if err == nil || err == ErrCircuitOpen {
+		return false
+	}
+	s, ok := status.FromError(err)
+	return ok && p.Codes[s.Code()]
+}
+
+// backoff returns the wait before the attempt after the nth, with full jitter
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	d := p.Backoff << uint(attempt)
+	if d <= 0 || d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// withRetries makes the call according to the policy of the method, using
+// attempt for each try
+func withRetries(ctx context.Context, method string, reply interface{}, attempt func(context.Context, interface{}) error) error {
+	name := shortMethodName(method)
+	p := retryPolicyOf(name)
+	safe := p.Idempotent || hasIdempotencyKey(ctx)
+
+	if !safe || p.Attempts <= 1 {
+		return attempt(ctx, reply)
+	}
+
+	start := time.Now()
+	var err error
+	for i := 0; i < p.Attempts; i++ {
+		if p.HedgeDelay > 0 {
+			err = hedge(ctx, p.HedgeDelay, reply, attempt)
+		} else {
+			err = attempt(ctx, reply)
+		}
+		if !p.retryable(err) || i == p.Attempts-1 {
+			return err
+		}
+
+		wait := p.backoff(i)
+		if time.Since(start)+wait > p.Budget {
+			return err
+		}
+		log.Printf("Retrying %s in %v after: %v", name, wait, err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+	return err
+}
+
+// hedge makes the call, and makes it a second time when the first didn't
+// answer after delay. The first successful reply is copied into reply.
+func hedge(ctx context.Context, delay time.Duration, reply interface{}, attempt func(context.Context, interface{}) error) error {
+	msg, ok := reply.(proto.Message)
+	if !ok {
+		return attempt(ctx, reply)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		reply proto.Message
+		err   error
+	}
+	results := make(chan result, 2)
+	try := func() {
+		r := reflect.New(reflect.TypeOf(msg).Elem()).Interface().(proto.Message)
+		results <- result{r, attempt(ctx, r)}
+	}
+
+	go try()
+	sent, received := 1, 0
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var err error
+	for received < sent {
+		select {
+		case <-timer.C:
+			sent++
+			go try()
+		case r := <-results:
+			received++
+			if r.err == nil {
+				msg.Reset()
+				proto.Merge(msg, r.reply)
+				return nil
+			}
+			err = r.err
+			if sent == 1 {
+				// no need to wait for the delay to find out the first one failed
+				return err
+			}
+		}
+	}
+	return err
+}
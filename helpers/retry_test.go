@@ -0,0 +1,181 @@
+package helpers
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// useRetryPolicy makes the policy apply to the method for the test
+func useRetryPolicy(method string, p retryPolicy) {
+	retryPolicies.Lock()
+	retryPolicies.byMethod[method] = p
+	retryPolicies.Unlock()
+}
+
+var testRetryPolicy = retryPolicy{
+	Attempts:   3,
+	Codes:      map[codes.Code]bool{codes.Unavailable: true},
+	Backoff:    time.Millisecond,
+	MaxBackoff: 5 * time.Millisecond,
+	Budget:     time.Second,
+	Idempotent: true,
+}
+
+// failing returns an attempt that fails with the errors in order, then succeeds
+func failing(calls *int32, errs ...error) func(context.Context, interface{}) error {
+	return func(ctx context.Context, reply interface{}) error {
+		n := int(atomic.AddInt32(calls, 1))
+		if n <= len(errs) {
+			return errs[n-1]
+		}
+		return nil
+	}
+}
+
+func TestWithRetries(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "down")
+	notFound := status.Error(codes.NotFound, "gone")
+
+	tests := []struct {
+		name      string
+		policy    func(p *retryPolicy)
+		key       string
+		errs      []error
+		wantCalls int32
+		wantErr   error
+	}{
+		{"succeeds", nil, "", nil, 1, nil},
+		{"retries transient errors", nil, "", []error{unavailable, unavailable}, 3, nil},
+		{"gives up after the attempts", nil, "", []error{unavailable, unavailable, unavailable}, 3, unavailable},
+		{"doesn't retry other codes", nil, "", []error{notFound}, 1, notFound},
+		{"doesn't retry an open circuit", nil, "", []error{ErrCircuitOpen}, 1, ErrCircuitOpen},
+		{"doesn't retry unsafe methods", func(p *retryPolicy) { p.Idempotent = false }, "", []error{unavailable}, 1, unavailable},
+		{"retries with an idempotency key", func(p *retryPolicy) { p.Idempotent = false }, "key", []error{unavailable}, 2, nil},
+		{"single attempt", func(p *retryPolicy) { p.Attempts = 1 }, "", []error{unavailable}, 1, unavailable},
+		{"over budget", func(p *retryPolicy) { p.Budget = 0 }, "", []error{unavailable}, 1, unavailable},
+		{"other codes", func(p *retryPolicy) { p.Codes = map[codes.Code]bool{codes.NotFound: true} }, "", []error{notFound, unavailable}, 2, unavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testRetryPolicy
+			if tt.policy != nil {
+				tt.policy(&p)
+			}
+			useRetryPolicy("TestService/"+tt.name, p)
+
+			var calls int32
+			ctx := WithIdempotencyKey(context.Background(), tt.key)
+			err := withRetries(ctx, "/acubed.TestService/"+tt.name, nil, failing(&calls, tt.errs...))
+			if err != tt.wantErr {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("attempts = %d, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestWithRetriesStopsWhenCancelled(t *testing.T) {
+	p := testRetryPolicy
+	p.Backoff, p.MaxBackoff = time.Hour, time.Hour
+	p.Budget = 2 * time.Hour
+	useRetryPolicy("TestService/Cancelled", p)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls int32
+	attempt := func(ctx context.Context, reply interface{}) error {
+		atomic.AddInt32(&calls, 1)
+		cancel()
+		return status.Error(codes.Unavailable, "down")
+	}
+	if err := withRetries(ctx, "/TestService/Cancelled", nil, attempt); status.Code(err) != codes.Unavailable {
+		t.Errorf("err = %v, want the last error", err)
+	}
+	if calls != 1 {
+		t.Errorf("attempts = %d, want 1", calls)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := retryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{0, 10 * time.Millisecond},
+		{1, 20 * time.Millisecond},
+		{2, 40 * time.Millisecond},
+		{3, 50 * time.Millisecond},
+		{70, 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if d := p.backoff(tt.attempt); d < 0 || d >= tt.max {
+				t.Fatalf("backoff(%d) = %v, want in [0, %v)", tt.attempt, d, tt.max)
+			}
+		}
+	}
+	if d := (retryPolicy{}).backoff(3); d != 0 {
+		t.Errorf("backoff without a maximum = %v, want 0", d)
+	}
+}
+
+func TestHedge(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "down")
+
+	// each attempt answers after its delay with its value, or fails when the value is empty
+	type answer struct {
+		delay time.Duration
+		value string
+	}
+	tests := []struct {
+		name      string
+		answers   []answer
+		want      string
+		wantErr   bool
+		wantCalls int32
+	}{
+		{"fast first attempt", []answer{{0, "first"}}, "first", false, 1},
+		{"slow first attempt", []answer{{time.Second, "first"}, {0, "second"}}, "second", false, 2},
+		{"hedge fails", []answer{{50 * time.Millisecond, "first"}, {0, ""}}, "first", false, 2},
+		{"first attempt fails fast", []answer{{0, ""}}, "", true, 1},
+		{"both fail", []answer{{20 * time.Millisecond, ""}, {0, ""}}, "", true, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			attempt := func(ctx context.Context, reply interface{}) error {
+				a := tt.answers[atomic.AddInt32(&calls, 1)-1]
+				select {
+				case <-time.After(a.delay):
+				case <-ctx.Done():
+					return status.Error(codes.Canceled, ctx.Err().Error())
+				}
+				if a.value == "" {
+					return unavailable
+				}
+				reply.(*wrappers.StringValue).Value = a.value
+				return nil
+			}
+
+			reply := &wrappers.StringValue{Value: "stale"}
+			err := hedge(context.Background(), 10*time.Millisecond, reply, attempt)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && reply.Value != tt.want {
+				t.Errorf("reply = %q, want %q", reply.Value, tt.want)
+			}
+			if n := atomic.LoadInt32(&calls); n != tt.wantCalls {
+				t.Errorf("attempts = %d, want %d", n, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -2,26 +2,137 @@ package helpers
 
 import (
 	"context"
-	"errors"
-	"fmt"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"log"
+	"sync"
 	"time"
 )
 
-func RunGrpc(ip string, f func(context.Context, *grpc.ClientConn) (interface{}, error)) (interface{}, error) {
+var upstreamConns = struct {
+	sync.Mutex
+	byIp map[string]*grpc.ClientConn
+}{
+	byIp: map[string]*grpc.ClientConn{},
+}
+
+// upstreamConn returns the connection to the upstream, which is shared by all
+// calls and balanced over its endpoints (see discovery.go)
+func upstreamConn(ip string) (*grpc.ClientConn, error) {
+	upstreamConns.Lock()
+	defer upstreamConns.Unlock()
+	if conn, ok := upstreamConns.byIp[ip]; ok {
+		return conn, nil
+	}
+
 	log.Printf("Starting gRPC connection to %s", ip)
-	conn, err := grpc.Dial(ip, grpc.WithInsecure(), grpc.WithBlock())
+	config := loadUpstreamConfig(upstreamName(ip))
+	security, err := loadUpstreamTlsConfig(upstreamName(ip)).dialOption(ip)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := grpc.Dial(upstreamScheme+":///"+ip, security,
+		grpc.WithDefaultServiceConfig(config.serviceConfig()),
+		grpc.WithUnaryInterceptor(intercept))
+	if err != nil {
+		return nil, err
+	}
+	upstreamConns.byIp[ip] = conn
+	return conn, nil
+}
+
+func RunGrpc(ip string, f func(context.Context, *grpc.ClientConn) (interface{}, error)) (interface{}, error) {
+	upstream := GetBreaker(upstreamName(ip))
+	done, err := upstream.Allow()
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("did not connect: %v", err))
+		log.Printf("Not connecting to %s, circuit is open", ip)
+		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	start := time.Now()
+	conn, err := upstreamConn(ip)
+	if err != nil {
+		done(err, time.Since(start))
+		return nil, err
+	}
+
+	calls := &callOutcome{}
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), callOutcomeKey, calls), time.Second*3)
+	defer cancel()
 
 	ret, err := f(ctx, conn)
 
-	cancel()
-	_ = conn.Close()
+	done(calls.worst(), time.Since(start))
+	if calls.rejected() {
+		// f may have wrapped the error, make sure it's still recognised
+		return nil, ErrCircuitOpen
+	}
 
 	return ret, err
 }
+
+const callOutcomeKey contextKey = "callOutcome"
+
+// callOutcome collects the outcome of the calls made by one RunGrpc
+type callOutcome struct {
+	mu            sync.Mutex
+	err           error
+	rejectedCalls int
+}
+
+func intercept(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	o, ok := ctx.Value(callOutcomeKey).(*callOutcome)
+	if !ok {
+		o = &callOutcome{}
+	}
+	return withRetries(ctx, method, reply, func(ctx context.Context, reply interface{}) error {
+		return o.attempt(ctx, method, req, reply, cc, invoker, opts...)
+	})
+}
+
+// attempt makes a single call through the breaker of the method
+func (o *callOutcome) attempt(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	var done func(error, time.Duration)
+	if b := methodBreaker(method); b != nil {
+		var err error
+		if done, err = b.Allow(); err != nil {
+			log.Printf("Not calling %s, circuit is open", method)
+			o.mu.Lock()
+			o.rejectedCalls++
+			o.mu.Unlock()
+			return err
+		}
+	}
+
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if done != nil {
+		done(err, time.Since(start))
+	}
+
+	// a hedged attempt that lost the race is cancelled, that says nothing about the upstream
+	if status.Code(err) == codes.Canceled && ctx.Err() != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	if isUpstreamFailure(err) || o.err == nil {
+		o.err = err
+	}
+	o.mu.Unlock()
+	return err
+}
+
+// worst returns an error of the calls, preferring one that counts as an upstream failure
+func (o *callOutcome) worst() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.err
+}
+
+func (o *callOutcome) rejected() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.rejectedCalls > 0
+}
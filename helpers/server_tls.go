@@ -0,0 +1,145 @@
+package helpers
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// The edge can terminate TLS itself when there's nothing in front of it to do
+// so. Setting TLS_CERT_FILE and TLS_KEY_FILE serves HTTPS on TLS_PORT (443),
+// picking up renewed certificates without a restart. TLS_MIN_VERSION (1.2) and
+// TLS_CIPHERS (Go cipher suite names, only used up to TLS 1.2) restrict what
+// clients may use. PORT then redirects to HTTPS, or isn't listened on at all
+// with TLS_REDIRECT=false.
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCipherSuites are the TLS 1.2 suites that may be put in TLS_CIPHERS, all
+// with forward secrecy. The names are those of the crypto/tls constants.
+var tlsCipherSuites = map[string]uint16{
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+}
+
+// IsTlsEnabled is true when the edge should serve HTTPS
+func IsTlsEnabled() bool {
+	return GetEnvString("TLS_CERT_FILE", "") != "" && GetEnvString("TLS_KEY_FILE", "") != ""
+}
+
+// ServerTlsConfig returns the configuration of the HTTPS listener
+func ServerTlsConfig() (*tls.Config, error) {
+	files := &certFiles{
+		certFile: GetEnvString("TLS_CERT_FILE", ""),
+		keyFile:  GetEnvString("TLS_KEY_FILE", ""),
+	}
+	if err := files.reload(); err != nil {
+		return nil, err
+	}
+
+	minVersion, ok := tlsVersions[GetEnvString("TLS_MIN_VERSION", "1.2")]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS_MIN_VERSION %s", GetEnvString("TLS_MIN_VERSION", ""))
+	}
+
+	config := &tls.Config{
+		MinVersion: minVersion,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			_, certificate := files.get()
+			return certificate, nil
+		},
+	}
+
+	if names := GetEnvList("TLS_CIPHERS", nil); len(names) > 0 {
+		for _, name := range names {
+			id, ok := tlsCipherSuites[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown or insecure cipher suite %s in TLS_CIPHERS", name)
+			}
+			config.CipherSuites = append(config.CipherSuites, id)
+		}
+	}
+
+	return config, nil
+}
+
+// RedirectToHttps sends every request to the same URL on the HTTPS listener
+func RedirectToHttps(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if port := GetEnvString("TLS_PORT", "443"); port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
+
+// Security headers are sent with every response. SECURITY_HEADER_<NAME>
+// replaces the value of one (eg. SECURITY_HEADER_X_FRAME_OPTIONS=SAMEORIGIN),
+// "off" leaves it out. Strict-Transport-Security is only sent over HTTPS and is
+// built from HSTS_MAX_AGE, HSTS_INCLUDE_SUBDOMAINS and HSTS_PRELOAD.
+
+var defaultSecurityHeaders = map[string]string{
+	"X-Content-Type-Options":  "nosniff",
+	"X-Frame-Options":         "DENY",
+	"Referrer-Policy":         "no-referrer",
+	"Content-Security-Policy": "default-src 'none'; frame-ancestors 'none'",
+}
+
+func loadSecurityHeaders() map[string]string {
+	headers := map[string]string{}
+	for name, def := range defaultSecurityHeaders {
+		key := EnvKey("SECURITY_HEADER", name, "")
+		if v := GetEnvString(key, def); v != "off" {
+			headers[name] = v
+		}
+	}
+	return headers
+}
+
+func strictTransportSecurity() string {
+	maxAge := GetEnvDuration("HSTS_MAX_AGE", 365*24*time.Hour)
+	if maxAge <= 0 {
+		return ""
+	}
+	hsts := fmt.Sprintf("max-age=%d", int64(maxAge.Seconds()))
+	if GetEnvBool("HSTS_INCLUDE_SUBDOMAINS", false) {
+		hsts += "; includeSubDomains"
+	}
+	if GetEnvBool("HSTS_PRELOAD", false) {
+		hsts += "; preload"
+	}
+	return hsts
+}
+
+// SecurityHeaders adds the configured security headers to every response
+func SecurityHeaders(next http.Handler) http.Handler {
+	headers := loadSecurityHeaders()
+	hsts := strictTransportSecurity()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range headers {
+			w.Header().Set(name, value)
+		}
+		if r.TLS != nil && hsts != "" {
+			w.Header().Set("Strict-Transport-Security", hsts)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
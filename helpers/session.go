@@ -0,0 +1,175 @@
+package helpers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Browsers can keep their token in an HttpOnly cookie instead of somewhere
+// scripts can read it, when SESSION_COOKIES=true. Cookie sessions are protected
+// against CSRF with a signed double submit token: it's set in a cookie the
+// portal can read, and has to be sent back in the X-Csrf-Token header with
+// every request that isn't a GET, HEAD or OPTIONS. Without a valid one the
+// session cookie is ignored.
+//
+// SESSION_COOKIE_NAME, SESSION_COOKIE_DOMAIN, SESSION_COOKIE_SAMESITE
+// (strict, lax or none) and SESSION_COOKIE_MAX_AGE configure the cookie.
+// SESSION_CSRF_SECRET signs the CSRF tokens. It has to be set, to at least 32
+// characters, when sessions are enabled: all replicas need the same one, and
+// tokens have to stay valid across restarts.
+// SESSION_COOKIE_INSECURE=true drops the Secure flag for local development.
+
+const (
+	sessionTokenKey contextKey = "sessionToken"
+	csrfHeader                 = "X-Csrf-Token"
+	minCsrfSecret              = 32
+)
+
+var sessions = loadSessionConfig()
+
+type sessionConfig struct {
+	enabled    bool
+	cookieName string
+	csrfName   string
+	domain     string
+	sameSite   http.SameSite
+	maxAge     int
+	secure     bool
+	secret     []byte
+}
+
+func loadSessionConfig() sessionConfig {
+	c := sessionConfig{
+		enabled:    GetEnvBool("SESSION_COOKIES", false),
+		cookieName: GetEnvString("SESSION_COOKIE_NAME", "acubed_session"),
+		domain:     GetEnvString("SESSION_COOKIE_DOMAIN", ""),
+		maxAge:     GetEnvInt("SESSION_COOKIE_MAX_AGE", 0),
+		secure:     !GetEnvBool("SESSION_COOKIE_INSECURE", false),
+		secret:     []byte(GetEnvString("SESSION_CSRF_SECRET", "")),
+	}
+	c.csrfName = c.cookieName + "_csrf"
+
+	switch strings.ToLower(GetEnvString("SESSION_COOKIE_SAMESITE", "lax")) {
+	case "strict":
+		c.sameSite = http.SameSiteStrictMode
+	case "none":
+		c.sameSite = http.SameSiteNoneMode
+	default:
+		c.sameSite = http.SameSiteLaxMode
+	}
+
+	return c
+}
+
+// CheckSessionConfig returns an error when cookie sessions are enabled
+// without a CSRF secret to sign their tokens with
+func CheckSessionConfig() error {
+	if sessions.enabled && len(sessions.secret) < minCsrfSecret {
+		return fmt.Errorf("SESSION_COOKIES needs a SESSION_CSRF_SECRET of at least %d characters", minCsrfSecret)
+	}
+	return nil
+}
+
+// IsSessionModeEnabled is true when clients may use cookie sessions
+func IsSessionModeEnabled() bool {
+	return sessions.enabled
+}
+
+func (c sessionConfig) cookie(name, value string, httpOnly bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Domain:   c.domain,
+		MaxAge:   c.maxAge,
+		Secure:   c.secure,
+		HttpOnly: httpOnly,
+		SameSite: c.sameSite,
+	}
+}
+
+// SetSessionCookie stores the token in the session cookie and returns the CSRF
+// token to send along with it
+func SetSessionCookie(w http.ResponseWriter, token string) string {
+	csrf := newCsrfToken(token)
+	http.SetCookie(w, sessions.cookie(sessions.cookieName, token, true))
+	http.SetCookie(w, sessions.cookie(sessions.csrfName, csrf, false))
+	return csrf
+}
+
+// ClearSessionCookie removes the session and CSRF cookies
+func ClearSessionCookie(w http.ResponseWriter) {
+	for _, name := range []string{sessions.cookieName, sessions.csrfName} {
+		c := sessions.cookie(name, "", name == sessions.cookieName)
+		c.MaxAge = -1
+		http.SetCookie(w, c)
+	}
+}
+
+// newCsrfToken returns a random value signed together with the session token,
+// so it can't be carried over to another session
+func newCsrfToken(session string) string {
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		log.Panicf("Could not generate a CSRF token: %v", err)
+	}
+	n := base64.RawURLEncoding.EncodeToString(nonce)
+	return n + "." + signCsrf(session, n)
+}
+
+func signCsrf(session, nonce string) string {
+	mac := hmac.New(sha256.New, sessions.secret)
+	_, _ = mac.Write([]byte(session + "." + nonce))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// hasValidCsrfToken checks the CSRF header against the cookie, and whether it
+// was issued for the session token of the request
+func hasValidCsrfToken(r *http.Request) bool {
+	header := r.Header.Get(csrfHeader)
+	csrf, err := r.Cookie(sessions.csrfName)
+	if err != nil || header == "" || header != csrf.Value {
+		return false
+	}
+	session, err := r.Cookie(sessions.cookieName)
+	return err == nil && isValidCsrfToken(session.Value, header)
+}
+
+func isValidCsrfToken(session, token string) bool {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	return hmac.Equal([]byte(parts[1]), []byte(signCsrf(session, parts[0])))
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// Sessions makes the token in the session cookie available to GetJwtToken,
+// for requests that don't send an Authorization header themselves
+func Sessions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(sessions.cookieName)
+		if !sessions.enabled || err != nil || cookie.Value == "" || r.Header.Get("Authorization") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !isSafeMethod(r.Method) && !hasValidCsrfToken(r) {
+			log.Printf("Ignoring session cookie of %s %s, CSRF token missing or invalid", r.Method, r.URL.Path)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionTokenKey, cookie.Value)))
+	})
+}
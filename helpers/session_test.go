@@ -0,0 +1,145 @@
+package helpers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// useTestSessions enables cookie sessions with a fixed secret until the returned func is called
+func useTestSessions() func() {
+	previous := sessions
+	sessions = sessionConfig{
+		enabled:    true,
+		cookieName: "session",
+		csrfName:   "session_csrf",
+		secure:     true,
+		secret:     []byte(strings.Repeat("s", minCsrfSecret)),
+	}
+	return func() { sessions = previous }
+}
+
+func TestCsrfTokens(t *testing.T) {
+	defer useTestSessions()()
+
+	single := newCsrfToken("token")
+	nonce := strings.Split(single, ".")[0]
+
+	tests := []struct {
+		name    string
+		session string
+		csrf    string
+		want    bool
+	}{
+		{"issued for the token", "token", single, true},
+		{"other session", "other", single, false},
+		{"unsigned", "token", nonce, false},
+		{"empty", "token", "", false},
+		{"signature of another nonce", "token", "other." + strings.Split(single, ".")[1], false},
+		{"forged signature", "token", nonce + "." + strings.Repeat("A", 43), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isValidCsrfToken(tt.session, tt.csrf); got != tt.want {
+				t.Errorf("isValidCsrfToken = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	sessions.secret = []byte(strings.Repeat("t", minCsrfSecret))
+	if isValidCsrfToken("token", single) {
+		t.Error("token signed with another secret was accepted")
+	}
+}
+
+func TestSessions(t *testing.T) {
+	defer useTestSessions()()
+	csrf := newCsrfToken("token")
+
+	tests := []struct {
+		name          string
+		method        string
+		authorization string
+		cookies       map[string]string
+		header        string
+		want          string
+	}{
+		{"safe method", http.MethodGet, "", map[string]string{"session": "token"}, "", "token"},
+		{"valid csrf", http.MethodPost, "", map[string]string{"session": "token", "session_csrf": csrf}, csrf, "token"},
+		{"no csrf", http.MethodPost, "", map[string]string{"session": "token"}, "", ""},
+		{"header without cookie", http.MethodPost, "", map[string]string{"session": "token"}, csrf, ""},
+		{"cookie without header", http.MethodPost, "", map[string]string{"session": "token", "session_csrf": csrf}, "", ""},
+		{"csrf of another session", http.MethodDelete, "", map[string]string{"session": "other", "session_csrf": csrf}, csrf, ""},
+		{"authorization header wins", http.MethodGet, "Bearer header", map[string]string{"session": "token"}, "", ""},
+		{"no cookie", http.MethodGet, "", nil, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			h := Sessions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got, _ = r.Context().Value(sessionTokenKey).(string)
+			}))
+
+			r := httptest.NewRequest(tt.method, "/", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			for name, value := range tt.cookies {
+				r.AddCookie(&http.Cookie{Name: name, Value: value})
+			}
+			if tt.header != "" {
+				r.Header.Set(csrfHeader, tt.header)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			if got != tt.want {
+				t.Errorf("session token = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetSessionCookie(t *testing.T) {
+	defer useTestSessions()()
+
+	w := httptest.NewRecorder()
+	csrf := SetSessionCookie(w, "token")
+
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+		if c.HttpOnly != (c.Name != sessions.csrfName) {
+			t.Errorf("cookie %s: HttpOnly = %v", c.Name, c.HttpOnly)
+		}
+	}
+	r.Header.Set(csrfHeader, csrf)
+
+	if !hasValidCsrfToken(r) {
+		t.Error("CSRF token of the new session was rejected")
+	}
+}
+
+func TestCheckSessionConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		secret  string
+		wantErr bool
+	}{
+		{"disabled", false, "", false},
+		{"enabled with a secret", true, strings.Repeat("s", minCsrfSecret), false},
+		{"enabled without a secret", true, "", true},
+		{"enabled with a short secret", true, "secret", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer useTestSessions()()
+			sessions.enabled = tt.enabled
+			sessions.secret = []byte(tt.secret)
+			if err := CheckSessionConfig(); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package helpers
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// Upstream connections use TLS, verified against the CA bundle in
+// UPSTREAM_<NAME>_TLS_CA (or UPSTREAM_TLS_CA, or else the system roots). When
+// UPSTREAM_<NAME>_TLS_CERT and _TLS_KEY are set the edge authenticates itself
+// with that client certificate (mutual TLS). UPSTREAM_<NAME>_TLS_SERVER_NAME
+// overrides the name the certificate of the upstream is checked against.
+// Certificate files are picked up again when they change, new connections use
+// the new ones. Plaintext needs UPSTREAM_<NAME>_PLAINTEXT=true or
+// UPSTREAM_PLAINTEXT=true, which is only meant for local development: the dev
+// deployment sets it, production mounts the certificates (see kubernetes/prod.yaml).
+
+const certCheckInterval = 5 * time.Second
+
+type upstreamTlsConfig struct {
+	Plaintext  bool
+	CaFile     string
+	CertFile   string
+	KeyFile    string
+	ServerName string
+}
+
+func loadUpstreamTlsConfig(name string) upstreamTlsConfig {
+	get := func(setting string) string {
+		return EnvKey("UPSTREAM", name, setting)
+	}
+	return upstreamTlsConfig{
+		Plaintext:  GetEnvBool(get("PLAINTEXT"), GetEnvBool("UPSTREAM_PLAINTEXT", false)),
+		CaFile:     GetEnvString(get("TLS_CA"), GetEnvString("UPSTREAM_TLS_CA", "")),
+		CertFile:   GetEnvString(get("TLS_CERT"), GetEnvString("UPSTREAM_TLS_CERT", "")),
+		KeyFile:    GetEnvString(get("TLS_KEY"), GetEnvString("UPSTREAM_TLS_KEY", "")),
+		ServerName: GetEnvString(get("TLS_SERVER_NAME"), ""),
+	}
+}
+
+// dialOption returns how connections to the upstream are secured
+func (c upstreamTlsConfig) dialOption(ip string) (grpc.DialOption, error) {
+	if c.Plaintext {
+		log.Printf("Connecting to %s without TLS", ip)
+		return grpc.WithInsecure(), nil
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, fmt.Errorf("client certificate for %s needs both a certificate and a key", ip)
+	}
+
+	files := &certFiles{caFile: c.CaFile, certFile: c.CertFile, keyFile: c.KeyFile}
+	if err := files.reload(); err != nil {
+		return nil, err
+	}
+	return grpc.WithTransportCredentials(&reloadingCredentials{files: files, serverName: c.ServerName}), nil
+}
+
+// certFiles keeps a CA bundle and/or certificate loaded from disk, loading
+// them again once the files change
+type certFiles struct {
+	caFile, certFile, keyFile string
+
+	mu          sync.Mutex
+	checked     time.Time
+	modified    map[string]time.Time
+	pool        *x509.CertPool // nil for the system roots
+	certificate *tls.Certificate
+}
+
+// get returns the current CA bundle and certificate
+func (f *certFiles) get() (*x509.CertPool, *tls.Certificate) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if time.Since(f.checked) > certCheckInterval {
+		f.checked = time.Now()
+		if f.changed() {
+			if err := f.load(); err != nil {
+				log.Printf("Keeping the previous certificates, could not reload: %v", err)
+				// try again next time, the files may be halfway through a rotation
+				f.modified = nil
+			} else {
+				log.Printf("Reloaded certificates from %s", f.files())
+			}
+		}
+	}
+	return f.pool, f.certificate
+}
+
+func (f *certFiles) reload() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.checked = time.Now()
+	f.changed()
+	return f.load()
+}
+
+func (f *certFiles) files() []string {
+	var files []string
+	for _, file := range []string{f.caFile, f.certFile, f.keyFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// changed records the modification times of the files and returns whether any changed
+func (f *certFiles) changed() bool {
+	if f.modified == nil {
+		f.modified = map[string]time.Time{}
+	}
+	changed := false
+	for _, file := range f.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(f.modified[file]) {
+			f.modified[file] = info.ModTime()
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (f *certFiles) load() error {
+	var pool *x509.CertPool
+	if f.caFile != "" {
+		pem, err := ioutil.ReadFile(f.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", f.caFile)
+		}
+	}
+
+	var certificate *tls.Certificate
+	if f.certFile != "" {
+		c, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+		if err != nil {
+			return err
+		}
+		certificate = &c
+	}
+
+	f.pool, f.certificate = pool, certificate
+	return nil
+}
+
+// reloadingCredentials are TLS transport credentials that use the current
+// certificates for every handshake
+type reloadingCredentials struct {
+	files      *certFiles
+	serverName string
+}
+
+func (c *reloadingCredentials) config() *tls.Config {
+	pool, _ := c.files.get()
+	config := &tls.Config{
+		RootCAs:    pool,
+		ServerName: c.serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if c.files.certFile != "" {
+		config.GetClientCertificate = c.clientCertificate
+	}
+	return config
+}
+
+// clientCertificate is asked for the certificate during the handshake, so a
+// rotated one is used without building new credentials
+func (c *reloadingCredentials) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	_, certificate := c.files.get()
+	if certificate == nil {
+		// no certificate is sent, the upstream decides whether that's enough
+		return &tls.Certificate{}, nil
+	}
+	return certificate, nil
+}
+
+func (c *reloadingCredentials) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return credentials.NewTLS(c.config()).ClientHandshake(ctx, authority, conn)
+}
+
+func (c *reloadingCredentials) ServerHandshake(net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, errors.New("upstream credentials are only meant for clients")
+}
+
+func (c *reloadingCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "tls", SecurityVersion: "1.2", ServerName: c.serverName}
+}
+
+func (c *reloadingCredentials) Clone() credentials.TransportCredentials {
+	return &reloadingCredentials{files: c.files, serverName: c.serverName}
+}
+
+func (c *reloadingCredentials) OverrideServerName(name string) error {
+	c.serverName = name
+	return nil
+}
@@ -0,0 +1,97 @@
+package helpers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate for the name and its key
+func writeTestCertificate(t *testing.T, certFile, keyFile, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func clientCertificateName(t *testing.T, c *reloadingCredentials) string {
+	certificate, err := c.config().GetClientCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestClientCertificateRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "edge-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeTestCertificate(t, certFile, keyFile, "first")
+
+	files := &certFiles{certFile: certFile, keyFile: keyFile}
+	if err := files.reload(); err != nil {
+		t.Fatal(err)
+	}
+	c := &reloadingCredentials{files: files}
+	if name := clientCertificateName(t, c); name != "first" {
+		t.Fatalf("certificate = %s, want first", name)
+	}
+
+	writeTestCertificate(t, certFile, keyFile, "second")
+	// make the change visible even on file systems with coarse modification times
+	later := time.Now().Add(time.Minute)
+	_ = os.Chtimes(certFile, later, later)
+	files.mu.Lock()
+	files.checked = time.Time{}
+	files.mu.Unlock()
+
+	if name := clientCertificateName(t, c); name != "second" {
+		t.Errorf("certificate after rotation = %s, want second", name)
+	}
+}
+
+func TestClientCertificateNeedsKey(t *testing.T) {
+	if _, err := (upstreamTlsConfig{CertFile: "tls.crt"}).dialOption("test:50551"); err == nil {
+		t.Error("a certificate without a key was accepted")
+	}
+	c := &reloadingCredentials{files: &certFiles{}}
+	if c.config().GetClientCertificate != nil {
+		t.Error("a client certificate is offered without one being configured")
+	}
+}
@@ -5,14 +5,15 @@ import (
 	"net/http"
 	"os"
 
+	"github.com/acubed-tm/edge/api/admin"
 	"github.com/acubed-tm/edge/api/auth"
 	"github.com/acubed-tm/edge/api/profile"
 	"github.com/acubed-tm/edge/api/tracking"
+	"github.com/acubed-tm/edge/api/webhooks"
+	"github.com/acubed-tm/edge/helpers"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/render"
-	"github.com/joho/godotenv"
-	"github.com/rs/cors"
 )
 
 func ShowAPIInfo(w http.ResponseWriter, r *http.Request) {
@@ -30,33 +31,43 @@ func ShowAPIInfo(w http.ResponseWriter, r *http.Request) {
 func Routes() *chi.Mux {
 	router := chi.NewRouter()
 
-	corsm := cors.New(cors.Options{
-		AllowedHeaders: []string{"*"},
-		// Enable Debugging for testing, consider disabling in production
-		Debug: true,
-	})
-
 	router.Use(
-		corsm.Handler, // Set default CORS headers
+		middleware.RequestID,   // Give every request an id, or keep the one of the client
+		helpers.WriteRequestId, // Send the id back as X-Request-ID
+		helpers.Cors,           // Set CORS headers from the policy of the environment
 		render.SetContentType(render.ContentTypeJSON), // Set content-Type headers as application/json
 		middleware.Logger,          // Log API request calls
 		middleware.DefaultCompress, // Compress results, mostly gzipping assets and json
 		middleware.RedirectSlashes, // Redirect slashes to no slash URL versions
 		middleware.Recoverer,       // Recover from panics without crashing server
+		helpers.SecurityHeaders,    // Set HSTS and the other security headers
+		helpers.Sessions,           // Accept the session cookie of browsers in place of a token
+		helpers.Idempotency,        // Replay the response to retried requests with an Idempotency-Key
 	)
 
 	router.Get("/", ShowAPIInfo)
+	router.Get("/metrics", admin.Metrics)
 	router.Route("/v1", func(r chi.Router) {
 		r.Mount("/auth", auth.Routes())
 		r.Mount("/profile", profile.Routes())
 		r.Mount("/tracking", tracking.Routes())
+		r.Mount("/webhooks", webhooks.Routes())
+		r.Mount("/admin", admin.Routes())
 	})
 
 	return router
 }
 
 func main() {
-	_ = godotenv.Load()
+	if err := helpers.CheckSessionConfig(); err != nil {
+		log.Fatalf("Could not start: %v", err)
+	}
+	if err := helpers.CheckMailer(); err != nil {
+		log.Fatalf("Could not start: %v", err)
+	}
+	if err := tracking.LoadCameraRegistry(); err != nil {
+		log.Fatalf("Could not start: %v", err)
+	}
 	router := Routes()
 
 	walkFunc := func(method string, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
@@ -72,7 +83,25 @@ func main() {
 		port = p
 	}
 
-	log.Printf("Running on port: %s\n", port)
+	if !helpers.IsTlsEnabled() {
+		log.Printf("Running on port: %s\n", port)
+		log.Fatal(http.ListenAndServe(":"+port, router))
+	}
+
+	tlsConfig, err := helpers.ServerTlsConfig()
+	if err != nil {
+		log.Fatalf("Could not set up TLS: %v", err)
+	}
+
+	if helpers.GetEnvBool("TLS_REDIRECT", true) {
+		go func() {
+			log.Printf("Redirecting port %s to HTTPS\n", port)
+			log.Fatal(http.ListenAndServe(":"+port, http.HandlerFunc(helpers.RedirectToHttps)))
+		}()
+	}
 
-	log.Fatal(http.ListenAndServe(":"+port, router))
+	tlsPort := helpers.GetEnvString("TLS_PORT", "443")
+	server := &http.Server{Addr: ":" + tlsPort, Handler: router, TLSConfig: tlsConfig}
+	log.Printf("Running HTTPS on port: %s\n", tlsPort)
+	log.Fatal(server.ListenAndServeTLS("", ""))
 }